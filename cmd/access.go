@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/golang/glog"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// fixpermsRoleName is the Role granting the fixperms init container the
+	// API access its leases and claim records need
+	fixpermsRoleName      = "volume-permissions-fixperms"
+	defaultServiceAccount = "default"
+)
+
+// fixpermsRoleFor names the Role and RoleBinding of a service account
+func fixpermsRoleFor(serviceAccount string) string {
+	return fixpermsRoleName + "-" + serviceAccount
+}
+
+// fixpermsAccessRules returns the rules fixperms needs for the leases and
+// claim records of the targets, scoped to their names. Leases cannot be
+// scoped on create. Claims named after the pod are granted for the pod
+// names known at admission, the others are returned as unscoped so the
+// caller reports them.
+func fixpermsAccessRules(tmpl *podTemplate, targets []*chownTarget) ([]rbacv1.PolicyRule, []string) {
+	var leases, claims, unscoped []string
+	for _, t := range targets {
+		if t.lease != "" && !containsString(leases, t.lease) {
+			leases = append(leases, t.lease)
+		}
+		if t.claim == "" {
+			continue
+		}
+		if !strings.Contains(t.claim, podNameReference) {
+			if !containsString(claims, t.claim) {
+				claims = append(claims, t.claim)
+			}
+			continue
+		}
+		if len(tmpl.podNames) == 0 {
+			unscoped = append(unscoped, t.claim)
+			continue
+		}
+		for _, pod := range tmpl.podNames {
+			if claim := strings.Replace(t.claim, podNameReference, pod, -1); !containsString(claims, claim) {
+				claims = append(claims, claim)
+			}
+		}
+	}
+
+	var rules []rbacv1.PolicyRule
+	if len(leases) > 0 {
+		rules = append(rules,
+			rbacv1.PolicyRule{APIGroups: []string{coordinationv1.GroupName}, Resources: []string{"leases"}, Verbs: []string{"create"}},
+			rbacv1.PolicyRule{APIGroups: []string{coordinationv1.GroupName}, Resources: []string{"leases"}, Verbs: []string{"get", "update"}, ResourceNames: leases},
+		)
+	}
+	if len(claims) > 0 {
+		rules = append(rules, rbacv1.PolicyRule{APIGroups: []string{corev1.GroupName}, Resources: []string{"persistentvolumeclaims"}, Verbs: []string{"get", "patch"}, ResourceNames: claims})
+	}
+	return rules, unscoped
+}
+
+// mergeRules adds the rules to the existing ones, the resource names of a
+// rule granting the same verbs on the same resources are merged and names
+// listed twice are dropped. It reports whether the existing rules changed.
+func mergeRules(existing, rules []rbacv1.PolicyRule) ([]rbacv1.PolicyRule, bool) {
+	changed := false
+	for i := range existing {
+		var names []string
+		for _, name := range existing[i].ResourceNames {
+			if !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+		if len(names) != len(existing[i].ResourceNames) {
+			existing[i].ResourceNames, changed = names, true
+		}
+	}
+	for _, rule := range rules {
+		merged := false
+		for i := range existing {
+			r := &existing[i]
+			if !reflect.DeepEqual(r.APIGroups, rule.APIGroups) || !reflect.DeepEqual(r.Resources, rule.Resources) || !reflect.DeepEqual(r.Verbs, rule.Verbs) || (len(r.ResourceNames) == 0) != (len(rule.ResourceNames) == 0) {
+				continue
+			}
+			for _, name := range rule.ResourceNames {
+				if !containsString(r.ResourceNames, name) {
+					r.ResourceNames = append(r.ResourceNames, name)
+					changed = true
+				}
+			}
+			merged = true
+			break
+		}
+		if !merged {
+			existing = append(existing, rule)
+			changed = true
+		}
+	}
+	return existing, changed
+}
+
+// pruneClaimNames drops the claim names of the rules that are neither granted
+// again nor the name of an existing claim, so the Role does not grow with every
+// claim the namespace ever had. A rule left without names is dropped rather
+// than granting every claim.
+func pruneClaimNames(rules, granted []rbacv1.PolicyRule, claims []string) []rbacv1.PolicyRule {
+	var keep []string
+	for _, rule := range granted {
+		if containsString(rule.Resources, "persistentvolumeclaims") {
+			keep = append(keep, rule.ResourceNames...)
+		}
+	}
+	var pruned []rbacv1.PolicyRule
+	for _, r := range rules {
+		if !containsString(r.APIGroups, corev1.GroupName) || !containsString(r.Resources, "persistentvolumeclaims") || len(r.ResourceNames) == 0 {
+			pruned = append(pruned, r)
+			continue
+		}
+		var names []string
+		for _, name := range r.ResourceNames {
+			if containsString(keep, name) || containsString(claims, name) {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			r.ResourceNames = names
+			pruned = append(pruned, r)
+		}
+	}
+	return pruned
+}
+
+// ensureServiceAccountAccess grants the service account the rules through a
+// Role and a RoleBinding of its own in its namespace. The Role is created or
+// updated to hold at least the rules, dropping the names of claims that are
+// gone when it grows; the RoleBinding is created when missing.
+func ensureServiceAccountAccess(ctx context.Context, clientset kubernetes.Interface, namespace, serviceAccount string, rules []rbacv1.PolicyRule) error {
+	name := fixpermsRoleFor(serviceAccount)
+	roles := clientset.RbacV1().Roles(namespace)
+	role, err := roles.Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		role = &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}, Rules: rules}
+		if _, err := roles.Create(ctx, role, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		var changed bool
+		if role.Rules, changed = mergeRules(role.Rules, rules); changed {
+			pvcs, err := clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				glog.Warningf("Could not list the claims of namespace %s, keeping the claims granted to %s: %v", namespace, name, err)
+			} else {
+				var claims []string
+				for _, pvc := range pvcs.Items {
+					claims = append(claims, pvc.Name)
+				}
+				role.Rules = pruneClaimNames(role.Rules, rules, claims)
+			}
+			if _, err := roles.Update(ctx, role, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount, Namespace: namespace}},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name},
+	}
+	if _, err := clientset.RbacV1().RoleBindings(namespace).Create(ctx, binding, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// grantFixpermsAccess gives the pod's service account the API access the
+// leases and claim records of the targets need. Without it fixperms fixes
+// the targets uncoordinated and unrecorded, which the warnings report.
+func (m *mutator) grantFixpermsAccess(ctx context.Context, tmpl *podTemplate, d *decision) {
+	rules, unscoped := fixpermsAccessRules(tmpl, d.targets)
+	if len(unscoped) > 0 {
+		d.warnings = append(d.warnings, fmt.Sprintf("claims %s are named after pods unknown at admission, fixperms cannot record fixes on them", strings.Join(unscoped, ", ")))
+	}
+	if len(rules) == 0 {
+		return
+	}
+	if tmpl.spec.AutomountServiceAccountToken != nil && !*tmpl.spec.AutomountServiceAccountToken {
+		d.warnings = append(d.warnings, "fixperms needs a service account token for leases and claim records but automountServiceAccountToken is false")
+	}
+	// dry runs must not have side effects
+	if m.clientset == nil || m.dryRun {
+		return
+	}
+	serviceAccount := tmpl.spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = defaultServiceAccount
+	}
+	if err := ensureServiceAccountAccess(ctx, m.clientset, tmpl.meta.Namespace, serviceAccount, rules); err != nil {
+		glog.Warningf("Could not grant service account %s/%s access for fixperms: %v", tmpl.meta.Namespace, serviceAccount, err)
+		d.warnings = append(d.warnings, fmt.Sprintf("could not grant service account %s access to leases and claims, fixperms works without them: %v", serviceAccount, err))
+	}
+}
+
+// applyPodEnv gives the injected containers the pod name and namespace,
+// fixperms takes leases and records claims in that namespace as that pod and
+// the claim names of per pod volumes refer to $(POD_NAME)
+func applyPodEnv(containers []corev1.Container) {
+	env := []corev1.EnvVar{
+		{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+		{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+	}
+	for i := range containers {
+		for _, e := range env {
+			if !hasEnv(containers[i].Env, e.Name) {
+				containers[i].Env = append(containers[i].Env, e)
+			}
+		}
+	}
+}
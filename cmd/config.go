@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// MutationConfig holds the operator supplied settings that drive the mutation.
+// The zero value reproduces the built-in behaviour.
+type MutationConfig struct {
+	// Template is the init container template. The placeholders
+	// replace-permission, /replace-mountPath and replace-mountName are replaced
+	// with the owner, mount path and volume name of the selected volume mount.
+	Template string `json:"template,omitempty"`
+	// NamespaceTemplates are init container templates namespaces select by
+	// name with the default-template annotation. The annotation is refused
+	// while none are configured: the injected container runs as root, so a
+	// namespace cannot bring a template of its own.
+	NamespaceTemplates map[string]string `json:"namespaceTemplates,omitempty"`
+	// FixpermsImage is the webhook image, when set and no Template is given the
+	// injected container runs its fixperms subcommand instead of a shell
+	// script
+	FixpermsImage string `json:"fixpermsImage,omitempty"`
+	// StorageClassNames restricts mutation to persistent volume claims, and
+	// StatefulSet volumeClaimTemplates, of these storage classes. All claims
+	// are eligible when empty.
+	StorageClassNames []string `json:"storageClassNames,omitempty"`
+	// InlineVolumeTypes opts inline volumes into mutation next to persistent
+	// volume claims and generic ephemeral volumes. Supported types are nfs and
+	// hostPath.
+	InlineVolumeTypes []string `json:"inlineVolumeTypes,omitempty"`
+	// ConflictPolicy decides what happens when containers sharing a volume
+	// disagree on its owner: first-wins (default), fail or group-writable
+	ConflictPolicy string `json:"conflictPolicy,omitempty"`
+	// SharedGroup is the group a volume is chowned to under the group-writable
+	// conflict policy, the pod fsGroup is used when unset. It is added to the
+	// pod's supplemental groups when it differs from the fsGroup.
+	SharedGroup *int64 `json:"sharedGroup,omitempty"`
+	// IgnoredContainers lists sidecars that are left out when deriving
+	// ownership and choosing volumes. The built-in list is used when unset.
+	IgnoredContainers *ContainerSelector `json:"ignoredContainers,omitempty"`
+	// AllowedVolumes and DeniedVolumes are volume name patterns, * matching any
+	// run of characters. Mounts of allowed volumes are eligible whatever their
+	// source, mounts of denied volumes never are.
+	AllowedVolumes []string `json:"allowedVolumes,omitempty"`
+	DeniedVolumes  []string `json:"deniedVolumes,omitempty"`
+	// Strategy is how volumes are fixed: chown (default) changes their owner,
+	// acl grants the owner access with POSIX ACLs, verify only checks the
+	// owner can write them. Pods select another strategy with the strategy
+	// annotation.
+	Strategy string `json:"strategy,omitempty"`
+	// ACLImages are patterns of the init container images providing setfacl,
+	// the acl strategy rejects pods whose injected image is not one of them.
+	// The bitnami shell images are used when unset.
+	ACLImages []string `json:"aclImages,omitempty"`
+	// OwnershipPresets give the containers running well-known images an owner
+	// when the pod declares none, the first matching preset applies. The
+	// built-in presets are used when unset, an empty list disables them.
+	OwnershipPresets []OwnershipPreset `json:"ownershipPresets,omitempty"`
+	// ImageInspection looks up the user in the image config of containers
+	// the pod and the presets give no owner
+	ImageInspection *ImageInspection `json:"imageInspection,omitempty"`
+	// Paths narrows down the entries of a volume that are fixed, pods
+	// override it with annotations
+	Paths *PathOptions `json:"paths,omitempty"`
+	// Coordination makes the pods sharing a claim fix it once
+	Coordination *Coordination `json:"coordination,omitempty"`
+	// RecordFixes records the owner and mode of every fixed claim on the claim
+	// and skips the fix while the claim records the same ones. Needs
+	// FixpermsImage.
+	RecordFixes bool `json:"recordFixes,omitempty"`
+	// SELinux relabels the fixed entries for SELinux enforcing nodes
+	SELinux *SELinuxRelabel `json:"selinux,omitempty"`
+	// Enforcement keeps fixing the volumes with a sidecar while the pod runs,
+	// needs FixpermsImage
+	Enforcement *Enforcement `json:"enforcement,omitempty"`
+	// NonRootPolicy decides how pods requiring non-root containers are
+	// fixed: override (default) runs the injected containers as root anyway,
+	// verify switches them to the verify strategy, deny rejects them
+	NonRootPolicy string `json:"nonRootPolicy,omitempty"`
+	// Hardening restricts the security context of the injected containers,
+	// every setting is on by default
+	Hardening *Hardening `json:"hardening,omitempty"`
+	// Controller configures the claim controller fixing bound claims with
+	// Jobs
+	Controller *ControllerConfig `json:"controller,omitempty"`
+}
+
+// ContainerSelector matches containers by name or by image. Image patterns
+// may use * to match any run of characters, slashes included.
+type ContainerSelector struct {
+	Names  []string `json:"names,omitempty"`
+	Images []string `json:"images,omitempty"`
+}
+
+// defaultIgnoredContainers are the service mesh and logging sidecars other
+// webhooks commonly inject next to the app
+var defaultIgnoredContainers = ContainerSelector{
+	Names:  []string{"istio-proxy", "linkerd-proxy", "fluent-bit"},
+	Images: []string{"*istio/proxyv2*", "*linkerd*/proxy:*", "*fluent-bit*"},
+}
+
+// matches reports whether the container is selected by name or image
+func (s *ContainerSelector) matches(c *corev1.Container) bool {
+	for _, name := range s.Names {
+		if c.Name == name {
+			return true
+		}
+	}
+	return matchAny(s.Images, c.Image)
+}
+
+// matchPattern matches s against a pattern in which * stands for any run of
+// characters
+func matchPattern(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if i == len(parts)-2 {
+			return strings.HasSuffix(s, part)
+		}
+		j := strings.Index(s, part)
+		if j < 0 {
+			return false
+		}
+		s = s[j+len(part):]
+	}
+	return s == ""
+}
+
+// template returns the init container template. The fixperms template is
+// used when a fixperms image is configured, unless the options need a shell
+// the webhook image does not provide.
+func (cfg *MutationConfig) template(opts *fixOptions) string {
+	if cfg == nil {
+		return initContainerTemplate
+	}
+	if cfg.Template != "" {
+		return cfg.Template
+	}
+	if cfg.FixpermsImage == "" || opts.strategy == strategyACL || opts.relabel != nil {
+		return initContainerTemplate
+	}
+	return strings.Replace(fixpermsContainerTemplate, "replace-image", cfg.FixpermsImage, -1)
+}
+
+func (cfg *MutationConfig) storageClassNames() []string {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.StorageClassNames
+}
+
+// storageClassListed reports whether the storage class is one of the
+// configured storage classes, which are exact names
+func (cfg *MutationConfig) storageClassListed(class string) bool {
+	for _, name := range cfg.storageClassNames() {
+		if name == class {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *MutationConfig) inlineVolumeType(volumeType string) bool {
+	if cfg == nil {
+		return false
+	}
+	for _, t := range cfg.InlineVolumeTypes {
+		if t == volumeType {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *MutationConfig) volumeAllowed(name string) bool {
+	return cfg != nil && matchAny(cfg.AllowedVolumes, name)
+}
+
+func (cfg *MutationConfig) volumeDenied(name string) bool {
+	return cfg != nil && matchAny(cfg.DeniedVolumes, name)
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *MutationConfig) recordFixes() bool {
+	return cfg != nil && cfg.RecordFixes
+}
+
+// ownershipContainers drops the ignored sidecars from the containers
+func (cfg *MutationConfig) ownershipContainers(containers []corev1.Container) []corev1.Container {
+	ignored := &defaultIgnoredContainers
+	if cfg != nil && cfg.IgnoredContainers != nil {
+		ignored = cfg.IgnoredContainers
+	}
+	var selected []corev1.Container
+	for i := range containers {
+		if ignored.matches(&containers[i]) {
+			glog.Infof("Ignoring container %s (%s) when deriving ownership", containers[i].Name, containers[i].Image)
+			continue
+		}
+		selected = append(selected, containers[i])
+	}
+	return selected
+}
+
+func (cfg *MutationConfig) conflictPolicy() string {
+	if cfg == nil || cfg.ConflictPolicy == "" {
+		return conflictPolicyFirstWins
+	}
+	return cfg.ConflictPolicy
+}
+
+// sharedGroup returns the group shared by containers that disagree on the
+// owner of a volume and the supplemental groups the pod needs to be a member
+func (cfg *MutationConfig) sharedGroup(podSecurityContext *corev1.PodSecurityContext) (*int64, []int64) {
+	var fsGroup *int64
+	var supplementalGroups []int64
+	if podSecurityContext != nil {
+		fsGroup, supplementalGroups = podSecurityContext.FSGroup, podSecurityContext.SupplementalGroups
+	}
+	if cfg == nil || cfg.SharedGroup == nil {
+		return fsGroup, nil
+	}
+	if fsGroup != nil && *fsGroup == *cfg.SharedGroup {
+		return cfg.SharedGroup, nil
+	}
+	for _, g := range supplementalGroups {
+		if g == *cfg.SharedGroup {
+			return cfg.SharedGroup, nil
+		}
+	}
+	return cfg.SharedGroup, []int64{*cfg.SharedGroup}
+}
+
+// loadMutationConfig reads the mutation configuration from a file. A missing
+// file yields the default configuration.
+func loadMutationConfig(configFile string) (*MutationConfig, error) {
+	if configFile == "" {
+		return &MutationConfig{}, nil
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		glog.Infof("Mutation configuration %s not found, using defaults", configFile)
+		return &MutationConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseMutationConfig(data)
+}
+
+func parseMutationConfig(data []byte) (*MutationConfig, error) {
+	glog.Infof("New mutation configuration: sha256sum %x", sha256.Sum256(data))
+
+	var cfg MutationConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	switch cfg.ConflictPolicy {
+	case "", conflictPolicyFirstWins, conflictPolicyFail, conflictPolicyGroupWritable:
+	default:
+		return nil, fmt.Errorf("unsupported conflict policy %q, expect %s, %s or %s", cfg.ConflictPolicy, conflictPolicyFirstWins, conflictPolicyFail, conflictPolicyGroupWritable)
+	}
+	if cfg.Strategy != "" {
+		if err := validStrategy(cfg.Strategy); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.NonRootPolicy != "" {
+		if err := validNonRootPolicy(cfg.NonRootPolicy); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range cfg.InlineVolumeTypes {
+		if t != volumeTypeNFS && t != volumeTypeHostPath {
+			return nil, fmt.Errorf("unsupported inline volume type %q, expect %s or %s", t, volumeTypeNFS, volumeTypeHostPath)
+		}
+	}
+	for name, template := range cfg.NamespaceTemplates {
+		if strings.TrimSpace(template) == "" {
+			return nil, fmt.Errorf("invalid namespaceTemplates: template %q is empty", name)
+		}
+	}
+	if err := validatePresets(cfg.OwnershipPresets); err != nil {
+		return nil, fmt.Errorf("invalid ownershipPresets: %v", err)
+	}
+	if cfg.ImageInspection != nil && cfg.ImageInspection.Timeout != nil && cfg.ImageInspection.Timeout.Duration <= 0 {
+		return nil, fmt.Errorf("invalid imageInspection timeout %s", cfg.ImageInspection.Timeout.Duration)
+	}
+	if err := cfg.Paths.validate(); err != nil {
+		return nil, fmt.Errorf("invalid paths: %v", err)
+	}
+	if cfg.Controller != nil && cfg.Controller.Owner != "" {
+		if _, _, err := parseOwner(cfg.Controller.Owner); err != nil {
+			return nil, fmt.Errorf("invalid controller: %v", err)
+		}
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// claimAnnotationFixOwnerKey asks the controller to fix a bound claim to
+	// the uid:gid it holds, overriding the configured owner
+	claimAnnotationFixOwnerKey = "volume-permissions-container-injector-webhook.malston.me/fix-owner"
+	// jobLabelClaimKey labels the Jobs of the controller with the claim they
+	// fix
+	jobLabelClaimKey = "volume-permissions-container-injector-webhook.malston.me/claim"
+	// namespaceInjectionLabelKey opts a namespace into the webhook and the
+	// controller with the value enabled
+	namespaceInjectionLabelKey = "volume-permissions-container-injection"
+
+	controllerLeaseName = "volume-permissions-controller"
+	jobNamePrefix       = "volume-permissions-"
+	// jobMountPath is where the Job mounts the claim it fixes
+	jobMountPath  = "/volume"
+	jobVolumeName = "volume"
+
+	defaultJobBackoffLimit            = int32(2)
+	defaultJobTTLSecondsAfterFinished = int32(600)
+)
+
+// ControllerConfig configures the controller mode, which fixes claims once
+// they are bound with a Job instead of an init container of the app pods
+type ControllerConfig struct {
+	// Owner is the uid:gid bound claims are fixed to. Only claims carrying
+	// the fix-owner annotation are fixed when unset.
+	Owner string `json:"owner,omitempty"`
+	// ServiceAccountName runs the Jobs, the namespace default when unset
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// TTLSecondsAfterFinished is how long finished Jobs are kept, 600 when
+	// unset
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+}
+
+func (cfg *MutationConfig) controller() *ControllerConfig {
+	if cfg == nil || cfg.Controller == nil {
+		return &ControllerConfig{}
+	}
+	return cfg.Controller
+}
+
+// parseOwner parses a uid:gid owner
+func parseOwner(owner string) (int64, int64, error) {
+	parts := strings.Split(strings.TrimSpace(owner), ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid owner %q, expect uid:gid", owner)
+	}
+	uid, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid owner %q, expect uid:gid", owner)
+	}
+	gid, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || gid < 0 {
+		return 0, 0, fmt.Errorf("invalid owner %q, expect uid:gid", owner)
+	}
+	return uid, gid, nil
+}
+
+// claimController fixes bound claims with one-shot Jobs and records the fix
+// on the claim once the Job succeeded
+type claimController struct {
+	config    *MutationConfig
+	clientset kubernetes.Interface
+	// claims, jobs, namespaces and queue are set up by run: the informer
+	// handlers queue the keys of changed objects and the workers sync them,
+	// retrying failed syncs with backoff
+	claims     corelisters.PersistentVolumeClaimLister
+	jobs       batchlisters.JobLister
+	namespaces corelisters.NamespaceLister
+	queue      workqueue.RateLimitingInterface
+}
+
+// controllerKey queues a claim or a Job of the controller
+type controllerKey struct {
+	job bool
+	key string
+}
+
+// claimOwner returns the owner the claim is fixed to, or an empty owner when
+// the claim is left alone
+func (c *claimController) claimOwner(pvc *corev1.PersistentVolumeClaim) (string, error) {
+	if pvc.Status.Phase != corev1.ClaimBound {
+		return "", nil
+	}
+	for _, namespace := range ignoredNamespaces {
+		if pvc.Namespace == namespace {
+			return "", nil
+		}
+	}
+	owner, ok := pvc.Annotations[claimAnnotationFixOwnerKey]
+	if !ok {
+		owner = c.config.controller().Owner
+	}
+	if owner == "" {
+		return "", nil
+	}
+	if len(c.config.storageClassNames()) > 0 {
+		class := pvc.Spec.StorageClassName
+		if class == nil || !c.config.storageClassListed(*class) {
+			return "", nil
+		}
+	}
+	if _, _, err := parseOwner(owner); err != nil {
+		return "", fmt.Errorf("invalid %s annotation: %v", claimAnnotationFixOwnerKey, err)
+	}
+	return strings.TrimSpace(owner), nil
+}
+
+// namespaceEnabled reports whether the namespace opted into the webhook, the
+// controller only fixes the claims of those namespaces
+func (c *claimController) namespaceEnabled(namespace string) (bool, error) {
+	ns, err := c.namespaces.Get(namespace)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return ns.Labels[namespaceInjectionLabelKey] == "enabled", nil
+}
+
+// syncClaim starts the Job fixing the claim unless the claim already records
+// the fix or its failure, or its namespace did not opt in. A finished Job
+// applying another fix or a failed one is replaced.
+func (c *claimController) syncClaim(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	owner, err := c.claimOwner(pvc)
+	if err != nil || owner == "" {
+		return err
+	}
+	paths, err := pathOptionsFor(c.config, pvc.Annotations)
+	if err != nil || claimRecorded(pvc.Annotations, owner, "", paths.record()) {
+		return err
+	}
+	if pvc.Annotations[claimAnnotationFixFailedKey] == recordFailedFix(owner, paths.record()) {
+		return nil
+	}
+	// verifying needs the identity of the app, retrying cannot help
+	if strategy, err := strategyFor(c.config, pvc.Annotations); err != nil || strategy == strategyVerify {
+		if err == nil {
+			glog.Infof("Leaving claim %s/%s alone, the %s strategy fixes nothing", pvc.Namespace, pvc.Name, strategyVerify)
+		}
+		return err
+	}
+	if enabled, err := c.namespaceEnabled(pvc.Namespace); err != nil || !enabled {
+		return err
+	}
+
+	job, err := c.fixJob(pvc, owner)
+	if err != nil {
+		return err
+	}
+	jobs := c.clientset.BatchV1().Jobs(pvc.Namespace)
+	_, err = jobs.Create(ctx, job, metav1.CreateOptions{})
+	if !apierrors.IsAlreadyExists(err) {
+		if err == nil {
+			glog.Infof("Started job %s/%s fixing claim %s to %s", job.Namespace, job.Name, pvc.Name, owner)
+		}
+		return err
+	}
+
+	existing, err := jobs.Get(ctx, job.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	// a failed Job of the same fix is only replaced once its failure was
+	// removed from the claim
+	if !jobFinished(existing) || claimRecorded(existing.Annotations, owner, "", paths.record()) && !jobFailed(existing) {
+		return nil
+	}
+	glog.Infof("Replacing job %s/%s fixing claim %s to %s by one fixing it to %s", job.Namespace, job.Name, pvc.Name, existing.Annotations[claimAnnotationOwnerKey], owner)
+	propagation := metav1.DeletePropagationBackground
+	return jobs.Delete(ctx, job.Name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+}
+
+// syncJob records the fix of a succeeded Job, or the failure of a failed
+// one, on its claim
+func (c *claimController) syncJob(ctx context.Context, job *batchv1.Job) error {
+	claim, ok := job.Labels[jobLabelClaimKey]
+	if !ok {
+		return nil
+	}
+	owner, paths := job.Annotations[claimAnnotationOwnerKey], job.Annotations[claimAnnotationPathsKey]
+	recorder := &claimRecorder{clientset: c.clientset, namespace: job.Namespace}
+	switch {
+	case jobFailed(job):
+		pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(job.Namespace).Get(ctx, claim, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fix := recordFailedFix(owner, paths)
+		if pvc.Annotations[claimAnnotationFixFailedKey] == fix {
+			return nil
+		}
+		glog.Warningf("Job %s/%s could not fix claim %s to %s, remove the %s annotation of the claim to retry", job.Namespace, job.Name, claim, owner, claimAnnotationFixFailedKey)
+		return recorder.recordFailure(ctx, claim, fix)
+	case job.Status.Succeeded == 0:
+		return nil
+	}
+
+	recorded, err := recorder.recorded(ctx, claim, owner, "", paths)
+	if err != nil || recorded {
+		return err
+	}
+	glog.Infof("Job %s/%s fixed claim %s to %s", job.Namespace, job.Name, claim, owner)
+	return recorder.record(ctx, claim, owner, "", paths)
+}
+
+// fixJob returns the Job fixing the claim, its container is the init
+// container the webhook would inject into an app pod mounting the claim
+func (c *claimController) fixJob(pvc *corev1.PersistentVolumeClaim, owner string) (*batchv1.Job, error) {
+	uid, gid, err := parseOwner(owner)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := pathOptionsFor(c.config, pvc.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	relabel, err := selinuxRelabelFor(c.config, pvc.Annotations, nil)
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := strategyFor(c.config, pvc.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	if strategy == strategyVerify {
+		return nil, fmt.Errorf("the %s strategy fixes nothing, the controller has no app identity to verify", strategyVerify)
+	}
+	opts := &fixOptions{strategy: strategy, paths: paths, relabel: relabel}
+	targets := []*chownTarget{{uid: uid, gid: gid, mountPath: jobMountPath, mountName: jobVolumeName}}
+
+	containerConfig, err := loadConfig(renderInitContainer(c.config.template(opts), targets, opts))
+	if err != nil {
+		return nil, err
+	}
+	containers := containerConfig.InitContainers
+	if strategy == strategyACL {
+		if err := c.config.checkACLImages(containers); err != nil {
+			return nil, err
+		}
+	}
+	if relabel != nil {
+		relabel.applyProcessContext(containers)
+	}
+	c.config.hardening().apply(containers, targets, opts)
+
+	settings := c.config.controller()
+	backoffLimit, ttl := defaultJobBackoffLimit, defaultJobTTLSecondsAfterFinished
+	if settings.TTLSecondsAfterFinished != nil {
+		ttl = *settings.TTLSecondsAfterFinished
+	}
+	// the status annotation keeps the webhook from injecting its init
+	// container into the Job
+	meta := metav1.ObjectMeta{
+		Labels: map[string]string{jobLabelClaimKey: pvc.Name},
+		Annotations: map[string]string{
+			admissionWebhookAnnotationStatusKey: "injected",
+			claimAnnotationOwnerKey:             owner,
+			claimAnnotationPathsKey:             paths.record(),
+		},
+	}
+	job := &batchv1.Job{
+		ObjectMeta: *meta.DeepCopy(),
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: meta,
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: settings.ServiceAccountName,
+					Containers:         containers,
+					Volumes: []corev1.Volume{{
+						Name:         jobVolumeName,
+						VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.Name}},
+					}},
+				},
+			},
+		},
+	}
+	job.Name = jobName(pvc.Name)
+	job.Namespace = pvc.Namespace
+	return job, nil
+}
+
+// jobName names the Job fixing the claim, long claim names are shortened
+// with a digest to stay within the 63 characters of the job-name label
+func jobName(claim string) string {
+	name := jobNamePrefix + claim
+	if len(name) <= 63 {
+		return name
+	}
+	return fmt.Sprintf("%s-%x", name[:52], sha256.Sum256([]byte(claim)))[:63]
+}
+
+func jobFinished(job *batchv1.Job) bool {
+	return job.Status.Succeeded > 0 || jobFailed(job)
+}
+
+func jobFailed(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// run watches claims and the Jobs of the controller, syncing them with one
+// worker until the context is done
+func (c *claimController) run(ctx context.Context, resync time.Duration) {
+	factory := informers.NewSharedInformerFactory(c.clientset, resync)
+	jobFactory := informers.NewSharedInformerFactoryWithOptions(c.clientset, resync, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+		o.LabelSelector = jobLabelClaimKey
+	}))
+	claims := factory.Core().V1().PersistentVolumeClaims()
+	namespaces := factory.Core().V1().Namespaces()
+	jobs := jobFactory.Batch().V1().Jobs()
+	c.claims, c.jobs, c.namespaces = claims.Lister(), jobs.Lister(), namespaces.Lister()
+	c.queue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "claims")
+	defer c.queue.ShutDown()
+
+	claims.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue(false, obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(false, obj) },
+	})
+	jobs.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue(true, obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(true, obj) },
+	})
+	factory.Start(ctx.Done())
+	jobFactory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), claims.Informer().HasSynced, namespaces.Informer().HasSynced, jobs.Informer().HasSynced) {
+		return
+	}
+	go func() {
+		for c.processNext(ctx) {
+		}
+	}()
+	<-ctx.Done()
+}
+
+func (c *claimController) enqueue(job bool, obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Could not queue %v: %v", obj, err)
+		return
+	}
+	c.queue.Add(controllerKey{job: job, key: key})
+}
+
+// processNext syncs the next queued claim or Job, requeuing it with backoff
+// when the sync failed. It returns false once the queue is shut down.
+func (c *claimController) processNext(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+	key := item.(controllerKey)
+	if err := c.sync(ctx, key); err != nil {
+		glog.Errorf("Could not sync %s, retrying: %v", key.key, err)
+		c.queue.AddRateLimited(item)
+		return true
+	}
+	c.queue.Forget(item)
+	return true
+}
+
+// sync syncs the claim or Job of the key, objects deleted since they were
+// queued are skipped
+func (c *claimController) sync(ctx context.Context, key controllerKey) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key.key)
+	if err != nil {
+		return err
+	}
+	if key.job {
+		job, err := c.jobs.Jobs(namespace).Get(name)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return c.syncJob(ctx, job)
+	}
+	pvc, err := c.claims.PersistentVolumeClaims(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.syncClaim(ctx, pvc)
+}
+
+// runLeading runs the function while holding the lease of the namespace, so
+// only one replica runs it. It returns when the context is done, or with an
+// error when the lease is lost.
+func runLeading(ctx context.Context, clientset kubernetes.Interface, lease, namespace, identity string, run func(ctx context.Context)) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: lease, Namespace: namespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				glog.Infof("Holding the %s lease as %s", lease, identity)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				glog.Infof("Released the %s lease as %s", lease, identity)
+			},
+		},
+	})
+	if ctx.Err() == nil {
+		return fmt.Errorf("lost the %s/%s lease", namespace, lease)
+	}
+	return nil
+}
+
+// runControllerCommand implements the controller subcommand, running the
+// claim controller without the webhook server
+func runControllerCommand(args []string) error {
+	fs := flag.NewFlagSet("controller", flag.ContinueOnError)
+	cfgFile := fs.String("initContainerCfgFile", "/etc/webhook/config/initcontainerconfig.yaml", "File containing the mutation configuration.")
+	namespace := fs.String("namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the leader election lease.")
+	identity := fs.String("identity", os.Getenv("POD_NAME"), "Identity of this replica in the leader election.")
+	resync := fs.Duration("resync", 10*time.Minute, "How often all claims and jobs are checked again.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *namespace == "" {
+		return fmt.Errorf("no lease namespace given, set -namespace or POD_NAMESPACE")
+	}
+	if *identity == "" {
+		*identity, _ = os.Hostname()
+	}
+
+	cfg, err := loadMutationConfig(*cfgFile)
+	if err != nil {
+		return err
+	}
+	clientset, err := inClusterClientset()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+		<-signalChan
+		cancel()
+	}()
+	c := &claimController{config: cfg, clientset: clientset}
+	return runLeading(ctx, clientset, controllerLeaseName, *namespace, *identity, func(ctx context.Context) { c.run(ctx, *resync) })
+}
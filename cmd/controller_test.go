@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func boundClaim(annotations map[string]string) *corev1.PersistentVolumeClaim {
+	class := "standard"
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-redis-0", Namespace: "sentry-pro", Annotations: annotations},
+		Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &class},
+		Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+	}
+}
+
+func enabledNamespace() *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "sentry-pro", Labels: map[string]string{namespaceInjectionLabelKey: "enabled"}}}
+}
+
+func TestClaimControllerSyncClaim(t *testing.T) {
+	cfg := &MutationConfig{FixpermsImage: "docker.io/malston/volume-permissions-container-injector:v1"}
+	getJob := func(clientset *fake.Clientset) (*batchv1.Job, error) {
+		return clientset.BatchV1().Jobs("sentry-pro").Get(context.TODO(), "volume-permissions-data-redis-0", metav1.GetOptions{})
+	}
+
+	t.Run("annotated claim gets a job", func(t *testing.T) {
+		pvc := boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001"})
+		clientset := fake.NewSimpleClientset(pvc)
+		assert.NoError(t, (&claimController{config: cfg, clientset: clientset, namespaces: namespaceLister(enabledNamespace())}).syncClaim(context.TODO(), pvc))
+
+		job, err := getJob(clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, "data-redis-0", job.Labels[jobLabelClaimKey])
+		assert.Equal(t, "1001:1001", job.Annotations[claimAnnotationOwnerKey])
+		pod := job.Spec.Template
+		assert.Equal(t, "injected", pod.Annotations[admissionWebhookAnnotationStatusKey], "the webhook leaves the job alone")
+		assert.Equal(t, corev1.RestartPolicyNever, pod.Spec.RestartPolicy)
+		assert.Equal(t, "data-redis-0", pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+		c := pod.Spec.Containers[0]
+		assert.Equal(t, "docker.io/malston/volume-permissions-container-injector:v1", c.Image)
+		assert.Equal(t, []string{"-uid=1001", "-gid=1001", "-mode=", "/volume"}, c.Args)
+		assert.Equal(t, corev1.VolumeMount{Name: jobVolumeName, MountPath: jobMountPath}, c.VolumeMounts[0])
+	})
+
+	t.Run("claims left alone", func(t *testing.T) {
+		pending := boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001"})
+		pending.Status.Phase = corev1.ClaimPending
+		for name, pvc := range map[string]*corev1.PersistentVolumeClaim{
+			"pending":     pending,
+			"no owner":    boundClaim(nil),
+			"recorded":    boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001", claimAnnotationOwnerKey: "1001:1001", claimAnnotationPathsKey: (*PathOptions)(nil).record()}),
+			"other class": boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001"}),
+			"class glob":  boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001"}),
+			"namespace":   boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001"}),
+		} {
+			config := cfg
+			switch name {
+			case "other class":
+				config = &MutationConfig{StorageClassNames: []string{"nfs-client"}}
+			case "class glob":
+				config = &MutationConfig{StorageClassNames: []string{"stan*"}}
+			}
+			namespace := enabledNamespace()
+			if name == "namespace" {
+				namespace.Labels = nil
+			}
+			clientset := fake.NewSimpleClientset(pvc)
+			assert.NoError(t, (&claimController{config: config, clientset: clientset, namespaces: namespaceLister(namespace)}).syncClaim(context.TODO(), pvc), name)
+			_, err := getJob(clientset)
+			assert.Error(t, err, name)
+		}
+	})
+
+	t.Run("configured owner", func(t *testing.T) {
+		pvc := boundClaim(nil)
+		clientset := fake.NewSimpleClientset(pvc)
+		c := &claimController{config: &MutationConfig{Controller: &ControllerConfig{Owner: "999:999"}}, clientset: clientset, namespaces: namespaceLister(enabledNamespace())}
+		assert.NoError(t, c.syncClaim(context.TODO(), pvc))
+		job, err := getJob(clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, "docker.io/bitnami/bitnami-shell:10", job.Spec.Template.Spec.Containers[0].Image)
+		assert.Contains(t, job.Spec.Template.Spec.Containers[0].Command[2], "chown -R 999:999 /volume")
+	})
+
+	t.Run("verify claim is left alone", func(t *testing.T) {
+		pvc := boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001", admissionWebhookAnnotationStrategyKey: strategyVerify})
+		clientset := fake.NewSimpleClientset(pvc)
+		assert.NoError(t, (&claimController{config: cfg, clientset: clientset, namespaces: namespaceLister(enabledNamespace())}).syncClaim(context.TODO(), pvc), "no error to retry")
+		_, err := getJob(clientset)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid owner", func(t *testing.T) {
+		pvc := boundClaim(map[string]string{claimAnnotationFixOwnerKey: "redis"})
+		err := (&claimController{config: cfg, clientset: fake.NewSimpleClientset(pvc), namespaces: namespaceLister(enabledNamespace())}).syncClaim(context.TODO(), pvc)
+		assert.EqualError(t, err, `invalid `+claimAnnotationFixOwnerKey+` annotation: invalid owner "redis", expect uid:gid`)
+	})
+
+	t.Run("finished job of another owner is replaced", func(t *testing.T) {
+		pvc := boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001"})
+		finished := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "volume-permissions-data-redis-0", Namespace: "sentry-pro", Annotations: map[string]string{claimAnnotationOwnerKey: "999:999"}},
+			Status:     batchv1.JobStatus{Succeeded: 1},
+		}
+		clientset := fake.NewSimpleClientset(pvc, finished)
+		c := &claimController{config: cfg, clientset: clientset, namespaces: namespaceLister(enabledNamespace())}
+		assert.NoError(t, c.syncClaim(context.TODO(), pvc))
+		_, err := getJob(clientset)
+		assert.Error(t, err, "deleted")
+
+		assert.NoError(t, c.syncClaim(context.TODO(), pvc))
+		job, err := getJob(clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, "1001:1001", job.Annotations[claimAnnotationOwnerKey])
+	})
+}
+
+func TestClaimControllerSyncJob(t *testing.T) {
+	pvc := boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001"})
+	clientset := fake.NewSimpleClientset(pvc)
+	c := &claimController{config: &MutationConfig{}, clientset: clientset, namespaces: namespaceLister(enabledNamespace())}
+	job, err := c.fixJob(pvc, "1001:1001")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.syncJob(context.TODO(), job))
+	claim, err := clientset.CoreV1().PersistentVolumeClaims("sentry-pro").Get(context.TODO(), "data-redis-0", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, claim.Annotations, claimAnnotationOwnerKey, "running job")
+
+	job.Status.Succeeded = 1
+	assert.NoError(t, c.syncJob(context.TODO(), job))
+	claim, err = clientset.CoreV1().PersistentVolumeClaims("sentry-pro").Get(context.TODO(), "data-redis-0", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "1001:1001", claim.Annotations[claimAnnotationOwnerKey])
+	assert.NoError(t, c.syncClaim(context.TODO(), claim), "recorded claims start no job")
+}
+
+func TestClaimControllerFailedJob(t *testing.T) {
+	pvc := boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001"})
+	clientset := fake.NewSimpleClientset(pvc)
+	c := &claimController{config: &MutationConfig{}, clientset: clientset, namespaces: namespaceLister(enabledNamespace())}
+	getClaim := func() *corev1.PersistentVolumeClaim {
+		claim, err := clientset.CoreV1().PersistentVolumeClaims("sentry-pro").Get(context.TODO(), "data-redis-0", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return claim
+	}
+	jobs := clientset.BatchV1().Jobs("sentry-pro")
+
+	assert.NoError(t, c.syncClaim(context.TODO(), pvc))
+	job, err := jobs.Get(context.TODO(), "volume-permissions-data-redis-0", metav1.GetOptions{})
+	assert.NoError(t, err)
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+	_, err = jobs.UpdateStatus(context.TODO(), job, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, c.syncJob(context.TODO(), job))
+	claim := getClaim()
+	assert.Equal(t, recordFailedFix("1001:1001", (*PathOptions)(nil).record()), claim.Annotations[claimAnnotationFixFailedKey])
+
+	assert.NoError(t, jobs.Delete(context.TODO(), job.Name, metav1.DeleteOptions{}), "the job TTL")
+	assert.NoError(t, c.syncClaim(context.TODO(), claim))
+	_, err = jobs.Get(context.TODO(), job.Name, metav1.GetOptions{})
+	assert.Error(t, err, "the failed fix is not started again")
+
+	claim.Annotations[claimAnnotationFixOwnerKey] = "999:999"
+	assert.NoError(t, c.syncClaim(context.TODO(), claim))
+	_, err = jobs.Get(context.TODO(), job.Name, metav1.GetOptions{})
+	assert.NoError(t, err, "another fix is started")
+
+	job.Status.Succeeded = 1
+	job.Status.Conditions = nil
+	job.Annotations[claimAnnotationOwnerKey] = "999:999"
+	assert.NoError(t, c.syncJob(context.TODO(), job))
+	assert.NotContains(t, getClaim().Annotations, claimAnnotationFixFailedKey, "a fix applied clears the failure")
+}
+
+func TestClaimControllerProcessNext(t *testing.T) {
+	pvc := boundClaim(map[string]string{claimAnnotationFixOwnerKey: "1001:1001"})
+	claims := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, claims.Add(pvc))
+	clientset := fake.NewSimpleClientset(pvc)
+	c := &claimController{
+		config:     &MutationConfig{},
+		clientset:  clientset,
+		claims:     corelisters.NewPersistentVolumeClaimLister(claims),
+		jobs:       batchlisters.NewJobLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		namespaces: namespaceLister(enabledNamespace()),
+		queue:      workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond)),
+	}
+	defer c.queue.ShutDown()
+
+	clientset.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unavailable")
+	})
+	c.enqueue(false, pvc)
+	assert.True(t, c.processNext(context.TODO()))
+	assert.Equal(t, 1, c.queue.NumRequeues(controllerKey{key: "sentry-pro/data-redis-0"}), "failed syncs are retried")
+
+	clientset.ReactionChain = clientset.ReactionChain[1:]
+	assert.True(t, c.processNext(context.TODO()))
+	assert.Equal(t, 0, c.queue.NumRequeues(controllerKey{key: "sentry-pro/data-redis-0"}))
+	_, err := clientset.BatchV1().Jobs("sentry-pro").Get(context.TODO(), "volume-permissions-data-redis-0", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	c.enqueue(true, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "gone", Namespace: "sentry-pro"}})
+	assert.True(t, c.processNext(context.TODO()), "deleted objects are skipped")
+	c.queue.ShutDown()
+	assert.False(t, c.processNext(context.TODO()))
+}
+
+func TestJobName(t *testing.T) {
+	assert.Equal(t, "volume-permissions-data-redis-0", jobName("data-redis-0"))
+	long := jobName(strings.Repeat("a", 60))
+	assert.Len(t, long, 63)
+	assert.NotEqual(t, long, jobName(strings.Repeat("a", 61)))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// admissionWebhookAnnotationCoordinateKey switches the coordination on or
+	// off for a pod, overriding the configuration
+	admissionWebhookAnnotationCoordinateKey = "volume-permissions-container-injector-webhook.malston.me/coordinate"
+	// leaseAnnotationFixedKey records on the lease the fix its last holder
+	// completed, later pods making the same fix skip it
+	leaseAnnotationFixedKey = "volume-permissions-container-injector-webhook.malston.me/fixed"
+	// leaseAnnotationFixedAtKey records when the fix was completed
+	leaseAnnotationFixedAtKey = "volume-permissions-container-injector-webhook.malston.me/fixed-at"
+
+	leaseNamePrefix      = "volume-permissions-"
+	defaultLeaseDuration = 30 * time.Second
+)
+
+// Coordination configures the fix of claims shared by several pods, like the
+// replicas of a Deployment mounting a ReadWriteMany claim. One pod takes a
+// lease named after the claim and fixes it while the others wait, and skip
+// the fix once the holder reports success.
+type Coordination struct {
+	// Enabled coordinates the fix of every pod, pods opt in or out with the
+	// coordinate annotation
+	Enabled bool `json:"enabled,omitempty"`
+	// LeaseDuration is how long the lease of a holder that stopped renewing
+	// it blocks the other pods, 30s when unset
+	LeaseDuration *metav1.Duration `json:"leaseDuration,omitempty"`
+}
+
+// coordinationFor reports whether the fix of the pod's shared claims is
+// coordinated
+func coordinationFor(cfg *MutationConfig, annotations map[string]string) (bool, error) {
+	if v, ok := annotations[admissionWebhookAnnotationCoordinateKey]; ok {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, fmt.Errorf("invalid %s annotation %q: %v", admissionWebhookAnnotationCoordinateKey, v, err)
+		}
+		return enabled, nil
+	}
+	return cfg != nil && cfg.Coordination != nil && cfg.Coordination.Enabled, nil
+}
+
+func (cfg *MutationConfig) leaseDuration() time.Duration {
+	if cfg == nil || cfg.Coordination == nil || cfg.Coordination.LeaseDuration == nil {
+		return defaultLeaseDuration
+	}
+	return cfg.Coordination.LeaseDuration.Duration
+}
+
+// assignLeases names the lease of every target on a claim the pod shares with
+// others after the claim, and the subPath when the target is part of it.
+// StatefulSet claim templates, ephemeral volumes and subPathExpr targets are
+// per pod and left uncoordinated.
+func assignLeases(tmpl *podTemplate, targets []*chownTarget) {
+	claims := map[string]string{}
+	for _, v := range tmpl.spec.Volumes {
+		if v.PersistentVolumeClaim != nil && tmpl.claimTemplate(v.Name) == nil {
+			claims[v.Name] = v.PersistentVolumeClaim.ClaimName
+		}
+	}
+	for _, t := range targets {
+		claim, ok := claims[t.mountName]
+		if !ok || t.subPathExpr != "" {
+			continue
+		}
+		t.lease = leaseName(claim, t.subPath)
+	}
+}
+
+func leaseName(claim, subPath string) string {
+	name := leaseNamePrefix + claim
+	if subPath == "" {
+		return name
+	}
+	// a short digest keeps the name valid whatever the subPath holds, claim
+	// names leave enough room below the 253 characters of a name
+	return fmt.Sprintf("%s-%x", name, sha256.Sum256([]byte(subPath)))[:len(name)+11]
+}
+
+// coordinate names the leases of the targets, or reports why the fix stays
+// uncoordinated
+func coordinate(tmpl *podTemplate, d *decision, template string) {
+	if !strings.Contains(template, "replace-args") {
+		d.warnings = append(d.warnings, "coordination needs the fixperms init container, configure a fixpermsImage; fixing uncoordinated")
+		return
+	}
+	assignLeases(tmpl, d.targets)
+}
+
+// leaseCoordinator runs a fix under a lease so the pods sharing a claim fix it
+// once
+type leaseCoordinator struct {
+	clientset kubernetes.Interface
+	namespace string
+	holder    string
+	duration  time.Duration
+	// poll is how often a waiting pod checks the lease
+	poll time.Duration
+}
+
+// run waits until the lease is free, or until its holder reports it made the
+// same fix and returns true without fixing. Otherwise it takes the lease,
+// renews it while fixing and records the fix on success.
+func (c *leaseCoordinator) run(ctx context.Context, name, fixed string, fix func() error) (bool, error) {
+	leases := c.clientset.CoordinationV1().Leases(c.namespace)
+	for {
+		lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			lease, err = leases.Create(ctx, c.hold(&coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: c.namespace}}), metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+		case err != nil:
+		case lease.Annotations[leaseAnnotationFixedKey] == fixed:
+			return true, nil
+		case c.free(lease):
+			lease, err = leases.Update(ctx, c.hold(lease), metav1.UpdateOptions{})
+			if apierrors.IsConflict(err) {
+				continue
+			}
+		default:
+			select {
+			case <-time.After(c.poll):
+				continue
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+		}
+		if err != nil {
+			return false, err
+		}
+		return false, c.fixHolding(ctx, lease, fixed, fix)
+	}
+}
+
+// fixHolding runs the fix while renewing the lease, then records the fix or,
+// on failure, releases the lease for the next pod
+func (c *leaseCoordinator) fixHolding(ctx context.Context, lease *coordinationv1.Lease, fixed string, fix func() error) error {
+	leases := c.clientset.CoordinationV1().Leases(c.namespace)
+	renewCtx, stop := context.WithCancel(ctx)
+	renewed := make(chan *coordinationv1.Lease)
+	go func() {
+		defer close(renewed)
+		current := lease
+		for {
+			select {
+			case <-time.After(c.duration / 3):
+				now := metav1.NewMicroTime(time.Now())
+				renewal := current.DeepCopy()
+				renewal.Spec.RenewTime = &now
+				if updated, err := leases.Update(renewCtx, renewal, metav1.UpdateOptions{}); err != nil {
+					glog.Warningf("Could not renew lease %s/%s: %v", c.namespace, lease.Name, err)
+				} else {
+					current = updated
+				}
+			case <-renewCtx.Done():
+				renewed <- current
+				return
+			}
+		}
+	}()
+	fixErr := fix()
+	stop()
+	lease = <-renewed
+
+	release := lease.DeepCopy()
+	release.Spec.HolderIdentity = nil
+	if fixErr == nil {
+		if release.Annotations == nil {
+			release.Annotations = map[string]string{}
+		}
+		release.Annotations[leaseAnnotationFixedKey] = fixed
+		release.Annotations[leaseAnnotationFixedAtKey] = time.Now().UTC().Format(time.RFC3339)
+	}
+	if _, err := leases.Update(ctx, release, metav1.UpdateOptions{}); err != nil {
+		glog.Warningf("Could not release lease %s/%s: %v", c.namespace, lease.Name, err)
+	}
+	return fixErr
+}
+
+// hold makes this pod the holder of the lease
+func (c *leaseCoordinator) hold(lease *coordinationv1.Lease) *coordinationv1.Lease {
+	lease = lease.DeepCopy()
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(c.duration / time.Second)
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != c.holder {
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions += *lease.Spec.LeaseTransitions
+		}
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	lease.Spec.HolderIdentity = &c.holder
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	return lease
+}
+
+// free reports whether the lease has no holder, is held by this pod or was
+// not renewed in time by its holder
+func (c *leaseCoordinator) free(lease *coordinationv1.Lease) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || *spec.HolderIdentity == c.holder {
+		return true
+	}
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return time.Since(spec.RenewTime.Time) > time.Duration(*spec.LeaseDurationSeconds)*time.Second
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func heldLease(holder string, renewed time.Time) *coordinationv1.Lease {
+	seconds := int32(30)
+	renewTime := metav1.NewMicroTime(renewed)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "volume-permissions-shared", Namespace: "sentry-pro"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewTime,
+		},
+	}
+}
+
+func TestLeaseCoordinator(t *testing.T) {
+	coordinator := func(clientset *fake.Clientset, holder string) *leaseCoordinator {
+		return &leaseCoordinator{clientset: clientset, namespace: "sentry-pro", holder: holder, duration: 30 * time.Second, poll: 10 * time.Millisecond}
+	}
+	getLease := func(clientset *fake.Clientset) *coordinationv1.Lease {
+		lease, err := clientset.CoordinationV1().Leases("sentry-pro").Get(context.TODO(), "volume-permissions-shared", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return lease
+	}
+
+	t.Run("first pod fixes, the next ones skip", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		fixes := 0
+		fix := func() error { fixes++; return nil }
+
+		skipped, err := coordinator(clientset, "web-1").run(context.TODO(), "volume-permissions-shared", "1001:1001", fix)
+		assert.NoError(t, err)
+		assert.False(t, skipped)
+		lease := getLease(clientset)
+		assert.Nil(t, lease.Spec.HolderIdentity)
+		assert.Equal(t, "1001:1001", lease.Annotations[leaseAnnotationFixedKey])
+
+		skipped, err = coordinator(clientset, "web-2").run(context.TODO(), "volume-permissions-shared", "1001:1001", fix)
+		assert.NoError(t, err)
+		assert.True(t, skipped)
+
+		skipped, err = coordinator(clientset, "web-3").run(context.TODO(), "volume-permissions-shared", "2000:2000", fix)
+		assert.NoError(t, err)
+		assert.False(t, skipped, "another owner is fixed again")
+		assert.Equal(t, 2, fixes)
+	})
+
+	t.Run("waits for the holder", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(heldLease("web-1", time.Now()))
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			lease := getLease(clientset)
+			lease.Spec.HolderIdentity = nil
+			lease.Annotations = map[string]string{leaseAnnotationFixedKey: "1001:1001"}
+			_, err := clientset.CoordinationV1().Leases("sentry-pro").Update(context.TODO(), lease, metav1.UpdateOptions{})
+			assert.NoError(t, err)
+		}()
+
+		skipped, err := coordinator(clientset, "web-2").run(context.TODO(), "volume-permissions-shared", "1001:1001", func() error {
+			t.Error("the fix of the holder is repeated")
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, skipped)
+	})
+
+	t.Run("takes over an expired lease", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(heldLease("web-1", time.Now().Add(-time.Minute)))
+		skipped, err := coordinator(clientset, "web-2").run(context.TODO(), "volume-permissions-shared", "1001:1001", func() error { return nil })
+		assert.NoError(t, err)
+		assert.False(t, skipped)
+		assert.Equal(t, int32(1), *getLease(clientset).Spec.LeaseTransitions)
+	})
+
+	t.Run("failed fix releases the lease", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := coordinator(clientset, "web-1").run(context.TODO(), "volume-permissions-shared", "1001:1001", func() error { return errors.New("read-only file system") })
+		assert.EqualError(t, err, "read-only file system")
+		lease := getLease(clientset)
+		assert.Nil(t, lease.Spec.HolderIdentity)
+		assert.NotContains(t, lease.Annotations, leaseAnnotationFixedKey)
+	})
+}
+
+func TestEvaluateCoordination(t *testing.T) {
+	tmpl := func() *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "web", Namespace: "sentry-pro"},
+			spec: &corev1.PodSpec{
+				ServiceAccountName: "web",
+				Containers: []corev1.Container{{
+					Name: "web",
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "shared", MountPath: "/srv/media"},
+						{Name: "shared", MountPath: "/srv/static", SubPath: "static"},
+					},
+				}},
+				SecurityContext: &corev1.PodSecurityContext{FSGroup: int64Ptr(1001)},
+				Volumes: []corev1.Volume{
+					{Name: "shared", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "media"}}},
+				},
+			},
+		}
+	}
+	cfg := &MutationConfig{
+		FixpermsImage: "docker.io/malston/volume-permissions-container-injector:v1",
+		Coordination:  &Coordination{Enabled: true},
+	}
+
+	t.Run("fixperms takes a lease per claim portion", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		d, err := (&mutator{config: cfg, clientset: clientset}).evaluate(context.TODO(), tmpl())
+		assert.NoError(t, err)
+		c := d.initContainers[0]
+		assert.Equal(t, []string{
+			"-lease-duration=30s",
+			"-uid=1001", "-gid=1001", "-mode=", "-lease=volume-permissions-media", "/srv/media",
+			"-uid=1001", "-gid=1001", "-mode=", "-lease=" + leaseName("media", "static"), "/srv/static",
+		}, c.Args)
+		assert.True(t, hasEnv(c.Env, "POD_NAME"))
+		assert.True(t, hasEnv(c.Env, "POD_NAMESPACE"))
+
+		role, err := clientset.RbacV1().Roles("sentry-pro").Get(context.TODO(), fixpermsRoleFor("web"), metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"volume-permissions-media", leaseName("media", "static")}, role.Rules[1].ResourceNames)
+		binding, err := clientset.RbacV1().RoleBindings("sentry-pro").Get(context.TODO(), fixpermsRoleFor("web"), metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "web", binding.Subjects[0].Name)
+	})
+
+	t.Run("dry runs grant nothing", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		d, err := (&mutator{config: cfg, clientset: clientset, dryRun: true}).evaluate(context.TODO(), tmpl())
+		assert.NoError(t, err)
+		assert.True(t, d.inject)
+		roles, err := clientset.RbacV1().Roles("sentry-pro").List(context.TODO(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, roles.Items)
+	})
+
+	t.Run("pod opts out", func(t *testing.T) {
+		pod := tmpl()
+		pod.meta.Annotations = map[string]string{admissionWebhookAnnotationCoordinateKey: "false"}
+		d, err := (&mutator{config: cfg}).evaluate(context.TODO(), pod)
+		assert.NoError(t, err)
+		assert.NotContains(t, d.initContainers[0].Args, "-lease-duration=30s")
+		assert.False(t, hasEnv(d.initContainers[0].Env, "POD_NAME"))
+	})
+
+	t.Run("shell template", func(t *testing.T) {
+		d, err := (&mutator{config: &MutationConfig{Coordination: &Coordination{Enabled: true}}}).evaluate(context.TODO(), tmpl())
+		assert.NoError(t, err)
+		assert.True(t, d.inject)
+		assert.Contains(t, d.warnings[0], "coordination needs the fixperms init container")
+	})
+}
+
+func TestFixpermsAccessRules(t *testing.T) {
+	targets := []*chownTarget{
+		{lease: "volume-permissions-data", claim: "data"},
+		{claim: "cache-" + podNameReference},
+	}
+	sts := &podTemplate{podNames: []string{"db-0", "db-1"}}
+	rules, unscoped := fixpermsAccessRules(sts, targets)
+	assert.Empty(t, unscoped)
+	assert.Equal(t, []rbacv1.PolicyRule{
+		{APIGroups: []string{"coordination.k8s.io"}, Resources: []string{"leases"}, Verbs: []string{"create"}},
+		{APIGroups: []string{"coordination.k8s.io"}, Resources: []string{"leases"}, Verbs: []string{"get", "update"}, ResourceNames: []string{"volume-permissions-data"}},
+		{APIGroups: []string{""}, Resources: []string{"persistentvolumeclaims"}, Verbs: []string{"get", "patch"}, ResourceNames: []string{"data", "cache-db-0", "cache-db-1"}},
+	}, rules)
+
+	rules, unscoped = fixpermsAccessRules(&podTemplate{}, targets)
+	assert.Equal(t, []string{"cache-" + podNameReference}, unscoped)
+	assert.Equal(t, []string{"data"}, rules[2].ResourceNames)
+
+	merged, changed := mergeRules(rules, []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"persistentvolumeclaims"}, Verbs: []string{"get", "patch"}, ResourceNames: []string{"logs"}},
+		{APIGroups: []string{"coordination.k8s.io"}, Resources: []string{"leases"}, Verbs: []string{"create"}},
+	})
+	assert.True(t, changed)
+	assert.Len(t, merged, 3)
+	assert.Equal(t, []string{"data", "logs"}, merged[2].ResourceNames)
+	_, changed = mergeRules(merged, merged)
+	assert.False(t, changed)
+
+	merged[2].ResourceNames = []string{"data", "logs", "data"}
+	merged, changed = mergeRules(merged, nil)
+	assert.True(t, changed, "names listed twice are dropped")
+	assert.Equal(t, []string{"data", "logs"}, merged[2].ResourceNames)
+
+	pruned := pruneClaimNames(merged, rules, []string{"logs"})
+	assert.Equal(t, []string{"data", "logs"}, pruned[2].ResourceNames, "granted and existing claims are kept")
+	pruned = pruneClaimNames(merged, rules[:2], []string{"logs"})
+	assert.Equal(t, []string{"logs"}, pruned[2].ResourceNames, "gone claims are dropped")
+	pruned = pruneClaimNames(merged, rules[:2], nil)
+	assert.Len(t, pruned, 2, "a rule left without names grants nothing rather than every claim")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// admissionWebhookAnnotationEnforceKey switches the enforcer sidecar on
+	// ("true" or the interval between passes, like "5m") or off ("false")
+	// for a pod, overriding the configuration
+	admissionWebhookAnnotationEnforceKey = "volume-permissions-container-injector-webhook.malston.me/enforce"
+
+	enforcerContainerName   = "volume-permissions-enforcer"
+	defaultEnforcerInterval = time.Minute
+)
+
+// Enforcement configures the enforcer sidecar, which keeps fixing the volumes
+// while the pod runs for apps sharing them with tools writing as other users,
+// like backup agents restoring files as root. The sidecar runs as root for
+// the lifetime of the pod with the CHOWN, FOWNER and DAC_OVERRIDE
+// capabilities the fix needs, giving every user able to exec into the pod
+// root access to its volumes. It never exits, pods running to completion
+// like those of Jobs and CronJobs do not get it.
+type Enforcement struct {
+	// Enabled injects the sidecar into every pod, pods opt in or out with
+	// the enforce annotation
+	Enabled bool `json:"enabled,omitempty"`
+	// Interval is the time between two passes over the volumes, 1m when
+	// unset
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// enforcementFor returns the interval of the enforcer sidecar of the pod, or
+// 0 when the configuration and the pod annotation leave it switched off
+func enforcementFor(cfg *MutationConfig, annotations map[string]string) (time.Duration, error) {
+	interval := defaultEnforcerInterval
+	enabled := false
+	if cfg != nil && cfg.Enforcement != nil {
+		enabled = cfg.Enforcement.Enabled
+		if cfg.Enforcement.Interval != nil {
+			interval = cfg.Enforcement.Interval.Duration
+		}
+	}
+	if v, ok := annotations[admissionWebhookAnnotationEnforceKey]; ok {
+		v = strings.TrimSpace(v)
+		if d, err := time.ParseDuration(v); err == nil {
+			enabled, interval = d > 0, d
+		} else if enabled, err = strconv.ParseBool(v); err != nil {
+			return 0, fmt.Errorf("invalid %s annotation %q: expect true, false or an interval like 5m", admissionWebhookAnnotationEnforceKey, v)
+		}
+	}
+	if !enabled {
+		return 0, nil
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid enforcement interval %s", interval)
+	}
+	return interval, nil
+}
+
+// runsToCompletion reports whether the pods of the template are meant to
+// terminate, which a sidecar running forever would prevent
+func runsToCompletion(tmpl *podTemplate) bool {
+	return tmpl.job || (tmpl.spec.RestartPolicy != "" && tmpl.spec.RestartPolicy != corev1.RestartPolicyAlways)
+}
+
+// enforcerContainer derives the sidecar from the injected fixperms container:
+// it mounts the same targets and runs fixperms with -watch, without leases
+// and claim records which only concern the first fix
+func enforcerContainer(injected *corev1.Container, targets []*chownTarget, opts *fixOptions, interval time.Duration) (corev1.Container, error) {
+	plain := make([]*chownTarget, len(targets))
+	for i, t := range targets {
+		copied := *t
+		copied.lease, copied.claim = "", ""
+		plain[i] = &copied
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(renderFixpermsArgs(plain, opts)), &args); err != nil {
+		return corev1.Container{}, err
+	}
+
+	sidecar := *injected.DeepCopy()
+	sidecar.Name = enforcerContainerName
+	sidecar.Args = append([]string{"-watch=" + interval.String(), "-progress=0", "-termination-message-path="}, args...)
+	return sidecar, nil
+}
+
+// appendContainers adds the containers after the existing ones, the app
+// container stays the default one of kubectl exec and logs
+func appendContainers(added []corev1.Container, basePath string) (patch []patchOperation) {
+	for _, c := range added {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath + "/-",
+			Value: c,
+		})
+	}
+	return patch
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEnforcementFor(t *testing.T) {
+	enabled := &MutationConfig{Enforcement: &Enforcement{Enabled: true, Interval: &metav1.Duration{Duration: 5 * time.Minute}}}
+
+	tests := []struct {
+		name        string
+		cfg         *MutationConfig
+		annotations map[string]string
+		want        time.Duration
+	}{
+		{name: "disabled by default"},
+		{name: "configured interval", cfg: enabled, want: 5 * time.Minute},
+		{name: "pod opts out", cfg: enabled, annotations: map[string]string{admissionWebhookAnnotationEnforceKey: "false"}},
+		{name: "pod opts in", annotations: map[string]string{admissionWebhookAnnotationEnforceKey: "true"}, want: time.Minute},
+		{name: "pod interval", cfg: enabled, annotations: map[string]string{admissionWebhookAnnotationEnforceKey: "30s"}, want: 30 * time.Second},
+		{name: "zero interval opts out", cfg: enabled, annotations: map[string]string{admissionWebhookAnnotationEnforceKey: "0s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := enforcementFor(tt.cfg, tt.annotations)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := enforcementFor(nil, map[string]string{admissionWebhookAnnotationEnforceKey: "often"})
+	assert.Error(t, err)
+}
+
+func TestEvaluateEnforcement(t *testing.T) {
+	m := &mutator{config: &MutationConfig{FixpermsImage: "docker.io/malston/volume-permissions-container-injector:v1"}}
+	tmpl := exporterPod("data", int64Ptr(1001))
+	tmpl.meta.Annotations = map[string]string{admissionWebhookAnnotationEnforceKey: "2m"}
+
+	d, err := m.evaluate(context.TODO(), tmpl)
+	assert.NoError(t, err)
+	if assert.Len(t, d.sidecars, 1) {
+		sidecar := d.sidecars[0]
+		assert.Equal(t, enforcerContainerName, sidecar.Name)
+		assert.Equal(t, d.initContainers[0].Image, sidecar.Image)
+		assert.Equal(t, d.initContainers[0].VolumeMounts, sidecar.VolumeMounts)
+		assert.Equal(t, []string{"-watch=2m0s", "-progress=0", "-termination-message-path=", "-uid=1001", "-gid=1001", "-mode=", "/data"}, sidecar.Args)
+	}
+
+	patch, err := createPatch(tmpl, d)
+	assert.NoError(t, err)
+	assert.Contains(t, string(patch), `{"op":"add","path":"/spec/containers/-","value":{"name":"volume-permissions-enforcer"`)
+
+	d, err = (&mutator{}).evaluate(context.TODO(), tmpl)
+	assert.NoError(t, err)
+	assert.Empty(t, d.sidecars)
+	assert.Contains(t, d.warnings[len(d.warnings)-1], "the enforcer sidecar needs the fixperms container")
+}
+
+func TestEvaluateEnforcementRunToCompletion(t *testing.T) {
+	m := &mutator{config: &MutationConfig{FixpermsImage: "docker.io/malston/volume-permissions-container-injector:v1"}}
+	job := exporterPod("data", int64Ptr(1001))
+	job.meta.Annotations = map[string]string{admissionWebhookAnnotationEnforceKey: "true"}
+	job.job = true
+	pod := exporterPod("data", int64Ptr(1001))
+	pod.meta.Annotations = map[string]string{admissionWebhookAnnotationEnforceKey: "true"}
+	pod.spec.RestartPolicy = corev1.RestartPolicyOnFailure
+
+	for _, tmpl := range []*podTemplate{job, pod} {
+		d, err := m.evaluate(context.TODO(), tmpl)
+		assert.NoError(t, err)
+		assert.True(t, d.inject)
+		assert.Empty(t, d.sidecars)
+		assert.Contains(t, d.warnings, "the enforcer sidecar never exits and would keep pods running to completion from completing; not enforcing")
+	}
+}
+
+func TestWalkerEnforce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enforce")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spec, err := parseModeSpec("g+rw")
+	assert.NoError(t, err)
+	w := &walker{paths: &PathOptions{}, maxDepth: -1, sem: make(chan struct{}, 1)}
+	stop := make(chan os.Signal)
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		w.enforce([]fixpermsTarget{{path: dir, uid: -1, gid: -1, mode: spec}}, 10*time.Millisecond, &out, stop)
+		close(done)
+	}()
+
+	restored := filepath.Join(dir, "restored")
+	assert.NoError(t, ioutil.WriteFile(restored, nil, 0600))
+	assert.Eventually(t, func() bool {
+		info, err := os.Stat(restored)
+		return err == nil && info.Mode().Perm() == 0660
+	}, time.Second, 10*time.Millisecond, "files written later are fixed")
+
+	stop <- os.Interrupt
+	<-done
+	assert.Contains(t, out.String(), "fixperms: enforcing every 10ms")
+	assert.Contains(t, out.String(), "fixperms: stopped enforcing after")
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fixpermsTarget is a directory tree fixpermsCommand fixes and the owner and
+// mode its entries get
+type fixpermsTarget struct {
+	path string
+	uid  int
+	gid  int
+	mode *modeSpec
+	// lease coordinates the fix with other pods sharing the tree
+	lease string
+	// claim records the fix, a fix the claim already records is skipped
+	claim string
+}
+
+// fixpermsSummary is written to the termination message path when the fix
+// ends, the kubelet reports it in the container status
+type fixpermsSummary struct {
+	Checked  int64    `json:"checked"`
+	Changed  int64    `json:"changed"`
+	Errors   int64    `json:"errors"`
+	Failures []string `json:"failures,omitempty"`
+	Duration string   `json:"duration"`
+}
+
+// maxReportedFailures keeps the summary below the 4096 bytes the kubelet
+// reads from the termination message path
+const maxReportedFailures = 10
+
+// runFixpermsCommand fixes the owner and mode of the directory trees given as
+// arguments. -uid, -gid and -mode apply to the paths that follow them, so one
+// invocation fixes trees that need different owners:
+//
+//	fixperms -exclude .snapshot -uid 1001 -gid 1001 /data -uid 999 -gid 999 -mode g+rwX /shared
+func runFixpermsCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("fixperms", flag.ContinueOnError)
+	uid := fs.Int("uid", -1, "User owning the entries of the following paths, -1 leaves the user as is.")
+	gid := fs.Int("gid", -1, "Group owning the entries of the following paths, -1 leaves the group as is.")
+	mode := fs.String("mode", "", "Mode change of the entries of the following paths, octal or symbolic like g+rwX.")
+	var include, exclude stringList
+	fs.Var(&include, "include", "Only fix the path roots and the entries matching this pattern with everything below them, repeatable.")
+	fs.Var(&exclude, "exclude", "Skip the entries matching this pattern with everything below them, repeatable.")
+	maxDepth := fs.Int("max-depth", -1, "How deep to descend below the path roots, -1 for no limit.")
+	xdev := fs.Bool("xdev", false, "Stay on the file system of each path root.")
+	parallel := fs.Int("parallel", runtime.NumCPU(), "Number of directories read in parallel.")
+	progress := fs.Duration("progress", 10*time.Second, "Interval between progress reports, 0 disables them.")
+	terminationMessagePath := fs.String("termination-message-path", "/dev/termination-log", "File receiving the JSON summary, empty disables it.")
+	lease := fs.String("lease", "", "Lease coordinating the fix of the following paths with other pods, empty fixes them uncoordinated.")
+	leaseNamespace := fs.String("lease-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the leases.")
+	holder := fs.String("holder", os.Getenv("POD_NAME"), "Identity holding the leases.")
+	leaseDuration := fs.Duration("lease-duration", defaultLeaseDuration, "How long a lease blocks other pods after its holder stopped renewing it.")
+	claim := fs.String("claim", "", "Claim in -lease-namespace recording the fix of the following paths, empty records nothing.")
+	verify := fs.Bool("verify", false, "Change nothing, fail when the entries are not writable by the user running fixperms.")
+	watch := fs.Duration("watch", 0, "Keep fixing the paths at this interval after the first fix until terminated, 0 fixes them once.")
+
+	var targets []fixpermsTarget
+	for rest := args; ; {
+		if err := fs.Parse(rest); err != nil {
+			return err
+		}
+		rest = fs.Args()
+		spec, err := parseModeSpec(*mode)
+		if err != nil {
+			return err
+		}
+		i := 0
+		for ; i < len(rest) && (rest[i] == "-" || !strings.HasPrefix(rest[i], "-")); i++ {
+			targets = append(targets, fixpermsTarget{path: rest[i], uid: *uid, gid: *gid, mode: spec, lease: *lease, claim: *claim})
+		}
+		if i == len(rest) {
+			break
+		}
+		rest = rest[i:]
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no paths given")
+	}
+	if *parallel < 1 {
+		*parallel = 1
+	}
+
+	w := &walker{
+		paths:    &PathOptions{Include: include, Exclude: exclude},
+		maxDepth: *maxDepth,
+		xdev:     *xdev,
+		verify:   *verify,
+		sem:      make(chan struct{}, *parallel),
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	if *progress > 0 {
+		go func() {
+			ticker := time.NewTicker(*progress)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					fmt.Fprintf(stdout, "fixperms: %d entries checked, %d changed, %d errors\n",
+						atomic.LoadInt64(&w.checked), atomic.LoadInt64(&w.changed), atomic.LoadInt64(&w.errors))
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	var clientset kubernetes.Interface
+	connected := false
+	connect := func() kubernetes.Interface {
+		if !connected {
+			connected = true
+			var err error
+			if clientset, err = inClusterClientset(); err != nil {
+				fmt.Fprintf(stdout, "fixperms: no cluster access, fixing uncoordinated and unrecorded: %v\n", err)
+			}
+		}
+		return clientset
+	}
+	if *holder == "" {
+		*holder, _ = os.Hostname()
+	}
+	ctx := context.Background()
+	for _, t := range targets {
+		var recorder *claimRecorder
+		owner, modeChange := recordOwner(int64(t.uid), int64(t.gid)), ""
+		if t.mode != nil {
+			modeChange = t.mode.spec
+		}
+		if t.claim != "" && connect() != nil {
+			recorder = &claimRecorder{clientset: clientset, namespace: *leaseNamespace}
+			recorded, err := recorder.recorded(ctx, t.claim, owner, modeChange, w.recordedPaths())
+			if err != nil {
+				fmt.Fprintf(stdout, "fixperms: could not read the record of claim %s: %v\n", t.claim, err)
+			} else if recorded {
+				fmt.Fprintf(stdout, "fixperms: claim %s already records %s, skipping %s\n", t.claim, owner, t.path)
+				continue
+			}
+		}
+
+		errors := atomic.LoadInt64(&w.errors)
+		if t.lease != "" && connect() != nil {
+			w.fixCoordinated(&leaseCoordinator{clientset: clientset, namespace: *leaseNamespace, holder: *holder, duration: *leaseDuration, poll: 2 * time.Second}, t, stdout)
+		} else if w.verify {
+			fmt.Fprintf(stdout, "fixperms: verifying %s is writable by %d:%d\n", t.path, os.Getuid(), os.Getgid())
+			w.fixTree(t)
+		} else {
+			fmt.Fprintf(stdout, "fixperms: fixing %s to %d:%d%s\n", t.path, t.uid, t.gid, t.mode)
+			w.fixTree(t)
+		}
+
+		if recorder != nil && atomic.LoadInt64(&w.errors) == errors {
+			if err := recorder.record(ctx, t.claim, owner, modeChange, w.recordedPaths()); err != nil {
+				fmt.Fprintf(stdout, "fixperms: could not record the fix on claim %s: %v\n", t.claim, err)
+			}
+		}
+	}
+	close(done)
+
+	summary := fixpermsSummary{
+		Checked:  w.checked,
+		Changed:  w.changed,
+		Errors:   w.errors,
+		Failures: w.failures,
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+	}
+	out, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s\n", out)
+	if *terminationMessagePath != "" {
+		if err := ioutil.WriteFile(*terminationMessagePath, out, 0644); err != nil {
+			fmt.Fprintf(stdout, "fixperms: writing summary to %s: %v\n", *terminationMessagePath, err)
+		}
+	}
+	if *watch > 0 {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		w.enforce(targets, *watch, stdout, stop)
+		return nil
+	}
+	if summary.Errors > 0 && w.verify {
+		return fmt.Errorf("%d entries are not writable by %d:%d", summary.Errors, os.Getuid(), os.Getgid())
+	}
+	if summary.Errors > 0 {
+		return fmt.Errorf("%d entries could not be fixed", summary.Errors)
+	}
+	return nil
+}
+
+// enforce fixes the targets again every interval until stop receives,
+// reporting the counters of every pass that changed or failed to change
+// entries and the totals since the start
+func (w *walker) enforce(targets []fixpermsTarget, interval time.Duration, stdout io.Writer, stop <-chan os.Signal) {
+	fmt.Fprintf(stdout, "fixperms: enforcing every %s\n", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for pass := 1; ; pass++ {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			fmt.Fprintf(stdout, "fixperms: stopped enforcing after %d passes, %d entries checked, %d changed, %d errors\n",
+				pass-1, atomic.LoadInt64(&w.checked), atomic.LoadInt64(&w.changed), atomic.LoadInt64(&w.errors))
+			return
+		}
+		checked, changed, errors := atomic.LoadInt64(&w.checked), atomic.LoadInt64(&w.changed), atomic.LoadInt64(&w.errors)
+		for _, t := range targets {
+			w.fixTree(t)
+		}
+		passChanged, passErrors := atomic.LoadInt64(&w.changed)-changed, atomic.LoadInt64(&w.errors)-errors
+		if passChanged > 0 || passErrors > 0 {
+			fmt.Fprintf(stdout, "fixperms: pass %d: %d entries checked, %d changed, %d errors; %d changed and %d errors in total\n",
+				pass, atomic.LoadInt64(&w.checked)-checked, passChanged, passErrors, atomic.LoadInt64(&w.changed), atomic.LoadInt64(&w.errors))
+		}
+	}
+}
+
+// inClusterClientset returns a clientset for the cluster the pod runs in
+func inClusterClientset() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// fixedMarker describes the fix of the target as recorded on its lease: the
+// owner, the mode and every option selecting the entries fixed, so a fix with
+// other options is not skipped
+func (w *walker) fixedMarker(t fixpermsTarget) string {
+	return fmt.Sprintf("%d:%d%s %s", t.uid, t.gid, t.mode, w.recordedPaths())
+}
+
+// recordedPaths describes the options selecting the entries fixed as the
+// claim records and lease markers do
+func (w *walker) recordedPaths() string {
+	paths := PathOptions{Include: w.paths.Include, Exclude: w.paths.Exclude, StopAtMountPoints: w.xdev}
+	if w.maxDepth >= 0 {
+		maxDepth := w.maxDepth
+		paths.MaxDepth = &maxDepth
+	}
+	return paths.record()
+}
+
+// fixCoordinated fixes the tree under its lease, or skips it when another pod
+// already made the same fix. The tree is fixed uncoordinated when the lease
+// cannot be used.
+func (w *walker) fixCoordinated(c *leaseCoordinator, t fixpermsTarget, stdout io.Writer) {
+	fixed := w.fixedMarker(t)
+	ran := false
+	fmt.Fprintf(stdout, "fixperms: taking lease %s/%s to fix %s\n", c.namespace, t.lease, t.path)
+	skipped, err := c.run(context.Background(), t.lease, fixed, func() error {
+		ran = true
+		fmt.Fprintf(stdout, "fixperms: fixing %s to %d:%d%s\n", t.path, t.uid, t.gid, t.mode)
+		errors := atomic.LoadInt64(&w.errors)
+		w.fixTree(t)
+		if atomic.LoadInt64(&w.errors) > errors {
+			return fmt.Errorf("fixing %s failed", t.path)
+		}
+		return nil
+	})
+	switch {
+	case skipped:
+		fmt.Fprintf(stdout, "fixperms: %s already fixed by the holder of lease %s\n", t.path, t.lease)
+	case err != nil && !ran:
+		fmt.Fprintf(stdout, "fixperms: not coordinating the fix of %s: %v\n", t.path, err)
+		fmt.Fprintf(stdout, "fixperms: fixing %s to %d:%d%s\n", t.path, t.uid, t.gid, t.mode)
+		w.fixTree(t)
+	}
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// walker fixes directory trees, reading up to cap(sem) directories in
+// parallel
+type walker struct {
+	paths    *PathOptions
+	maxDepth int
+	xdev     bool
+	// verify checks the entries are writable instead of fixing them
+	verify bool
+	sem    chan struct{}
+
+	checked int64
+	changed int64
+	errors  int64
+
+	mu       sync.Mutex
+	failures []string
+}
+
+func (w *walker) fixTree(t fixpermsTarget) {
+	root := filepath.Clean(t.path)
+	info, err := os.Lstat(root)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	w.fix(t, root, info)
+	if !info.IsDir() {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	w.walk(t, root, root, deviceOf(info), 1, &wg)
+	wg.Wait()
+}
+
+// walk fixes the entries of dir and descends into its subdirectories, in a
+// goroutine of its own while the parallelism allows and inline otherwise
+func (w *walker) walk(t fixpermsTarget, root, dir string, dev uint64, depth int, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if w.maxDepth >= 0 && depth > w.maxDepth {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		rel := relativePath(root, name)
+		if w.excluded(rel) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			w.fail(err)
+			continue
+		}
+		if w.included(rel) {
+			w.fix(t, name, info)
+		}
+		if !info.IsDir() || w.xdev && deviceOf(info) != dev {
+			continue
+		}
+		wg.Add(1)
+		select {
+		case w.sem <- struct{}{}:
+			go func() {
+				defer func() { <-w.sem }()
+				w.walk(t, root, name, dev, depth+1, wg)
+			}()
+		default:
+			w.walk(t, root, name, dev, depth+1, wg)
+		}
+	}
+}
+
+// fix changes the owner and mode of an entry unless they are already right.
+// Symbolic links are chowned themselves and never chmod'ed.
+func (w *walker) fix(t fixpermsTarget, name string, info os.FileInfo) {
+	atomic.AddInt64(&w.checked, 1)
+	if w.verify {
+		w.check(name, info)
+		return
+	}
+	changed := false
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid := t.uid, t.gid
+		if uid < 0 {
+			uid = int(st.Uid)
+		}
+		if gid < 0 {
+			gid = int(st.Gid)
+		}
+		if uint32(uid) != st.Uid || uint32(gid) != st.Gid {
+			if err := os.Lchown(name, uid, gid); err != nil {
+				w.fail(err)
+				return
+			}
+			changed = true
+		}
+	}
+	if t.mode != nil && info.Mode()&os.ModeSymlink == 0 {
+		if mode := t.mode.apply(info.Mode()); mode != info.Mode().Perm() {
+			if err := os.Chmod(name, info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)|mode); err != nil {
+				w.fail(err)
+				return
+			}
+			changed = true
+		}
+	}
+	if changed {
+		atomic.AddInt64(&w.changed, 1)
+	}
+}
+
+// accessWrite is the W_OK mode of access(2)
+const accessWrite = 0x2
+
+// check fails entries the user running fixperms cannot write, symbolic links
+// are not checked
+func (w *walker) check(name string, info os.FileInfo) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+	if err := syscall.Access(name, accessWrite); err != nil {
+		w.fail(fmt.Errorf("%s: not writable by %d:%d", name, os.Getuid(), os.Getgid()))
+	}
+}
+
+func (w *walker) fail(err error) {
+	atomic.AddInt64(&w.errors, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.failures) < maxReportedFailures {
+		w.failures = append(w.failures, err.Error())
+	}
+}
+
+// relativePath returns the path of the entry below the root the include and
+// exclude patterns match, a root of / included
+func relativePath(root, name string) string {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return name
+	}
+	return filepath.ToSlash(rel)
+}
+
+// excluded reports whether the entry matches an exclude pattern
+func (w *walker) excluded(rel string) bool {
+	for _, p := range w.paths.Exclude {
+		if matchPathPattern(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// included reports whether the entry, or one of the directories it is in,
+// matches an include pattern. Everything is included without patterns.
+func (w *walker) included(rel string) bool {
+	if len(w.paths.Include) == 0 {
+		return true
+	}
+	for _, p := range w.paths.Include {
+		for prefix := rel; ; {
+			if matchPathPattern(p, prefix) {
+				return true
+			}
+			i := strings.LastIndex(prefix, "/")
+			if i < 0 {
+				break
+			}
+			prefix = prefix[:i]
+		}
+	}
+	return false
+}
+
+// matchPathPattern matches the path of an entry relative to the root like
+// findCommand: a pattern without a slash matches the entry name, a pattern
+// with one the whole relative path
+func matchPathPattern(pattern, rel string) bool {
+	pattern = strings.Replace(strings.Trim(pattern, "/"), "**", "*", -1)
+	if strings.Contains(pattern, "/") {
+		return matchPattern(pattern, rel)
+	}
+	return matchPattern(pattern, filepath.Base(rel))
+}
+
+func deviceOf(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
+
+// modeSpec is a mode change, either an octal mode or symbolic clauses like
+// u+rw,g=rX,o-w
+type modeSpec struct {
+	spec    string
+	octal   *os.FileMode
+	clauses []modeClause
+}
+
+type modeClause struct {
+	who  os.FileMode
+	op   byte
+	perm string
+}
+
+func parseModeSpec(spec string) (*modeSpec, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if octal, err := strconv.ParseUint(spec, 8, 32); err == nil {
+		mode := os.FileMode(octal) & os.ModePerm
+		return &modeSpec{spec: spec, octal: &mode}, nil
+	}
+	m := &modeSpec{spec: spec}
+	for _, clause := range strings.Split(spec, ",") {
+		i := strings.IndexAny(clause, "+-=")
+		if i < 0 || strings.Trim(clause[i+1:], "rwxX") != "" {
+			return nil, fmt.Errorf("invalid mode %q", spec)
+		}
+		var who os.FileMode
+		for _, c := range clause[:i] {
+			switch c {
+			case 'u':
+				who |= 0700
+			case 'g':
+				who |= 0070
+			case 'o':
+				who |= 0007
+			case 'a':
+				who |= 0777
+			default:
+				return nil, fmt.Errorf("invalid mode %q", spec)
+			}
+		}
+		if who == 0 {
+			who = 0777
+		}
+		m.clauses = append(m.clauses, modeClause{who: who, op: clause[i], perm: clause[i+1:]})
+	}
+	return m, nil
+}
+
+func (m *modeSpec) String() string {
+	if m == nil {
+		return ""
+	}
+	return " mode " + m.spec
+}
+
+// apply returns the permission bits of an entry of the given mode after the
+// change. X grants execute to directories and to entries executable by
+// anyone.
+func (m *modeSpec) apply(mode os.FileMode) os.FileMode {
+	if m.octal != nil {
+		return *m.octal
+	}
+	perm := mode.Perm()
+	for _, c := range m.clauses {
+		var bits os.FileMode
+		for _, p := range c.perm {
+			switch p {
+			case 'r':
+				bits |= 0444
+			case 'w':
+				bits |= 0222
+			case 'x':
+				bits |= 0111
+			case 'X':
+				if mode.IsDir() || perm&0111 != 0 {
+					bits |= 0111
+				}
+			}
+		}
+		bits &= c.who
+		switch c.op {
+		case '+':
+			perm |= bits
+		case '-':
+			perm &^= bits
+		case '=':
+			perm = perm&^c.who | bits
+		}
+	}
+	return perm
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunFixpermsCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixperms")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	for _, d := range []string{"db/base", ".snapshot/hourly", "lost+found"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(data, d), 0755))
+	}
+	for _, f := range []string{"db/base/1", ".snapshot/hourly/1", "run.sh"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(data, f), nil, 0644))
+	}
+	assert.NoError(t, os.Chmod(filepath.Join(data, "run.sh"), 0744))
+	summaryFile := filepath.Join(dir, "termination-log")
+
+	run := func() fixpermsSummary {
+		var out bytes.Buffer
+		err := runFixpermsCommand([]string{
+			"-exclude=.snapshot", "-exclude=lost+found", "-parallel=2", "-termination-message-path=" + summaryFile,
+			"-uid", "-1", "-gid", "-1", "-mode", "g+rwX", data,
+		}, &out)
+		assert.NoError(t, err)
+		var summary fixpermsSummary
+		raw, err := ioutil.ReadFile(summaryFile)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(raw, &summary))
+		return summary
+	}
+
+	summary := run()
+	assert.Equal(t, int64(5), summary.Checked, "data, db, db/base, db/base/1 and run.sh")
+	assert.Equal(t, int64(5), summary.Changed)
+	assert.Zero(t, summary.Errors)
+	assert.NotEmpty(t, summary.Duration)
+
+	mode := func(name string) os.FileMode {
+		info, err := os.Stat(filepath.Join(data, name))
+		assert.NoError(t, err)
+		return info.Mode().Perm()
+	}
+	assert.Equal(t, os.FileMode(0775), mode("db/base"))
+	assert.Equal(t, os.FileMode(0664), mode("db/base/1"))
+	assert.Equal(t, os.FileMode(0774), mode("run.sh"))
+	assert.Equal(t, os.FileMode(0644), mode(".snapshot/hourly/1"))
+
+	summary = run()
+	assert.Equal(t, int64(5), summary.Checked)
+	assert.Zero(t, summary.Changed, "entries already right are left alone")
+}
+
+func TestRunFixpermsCommandArguments(t *testing.T) {
+	var out bytes.Buffer
+	assert.EqualError(t, runFixpermsCommand([]string{"-uid=1001"}, &out), "no paths given")
+	assert.Error(t, runFixpermsCommand([]string{"-mode=g+s", "/data"}, &out))
+	assert.Error(t, runFixpermsCommand([]string{"-termination-message-path=", "/does/not/exist"}, &out))
+}
+
+func TestModeSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		mode os.FileMode
+		want os.FileMode
+	}{
+		{spec: "g+rwX", mode: 0644, want: 0664},
+		{spec: "g+rwX", mode: os.ModeDir | 0755, want: 0775},
+		{spec: "u=rw,go-rwx", mode: 0755, want: 0600},
+		{spec: "+X", mode: 0744, want: 0755},
+		{spec: "750", mode: 0644, want: 0750},
+	}
+	for _, tt := range tests {
+		spec, err := parseModeSpec(tt.spec)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, spec.apply(tt.mode), tt.spec)
+	}
+}
+
+func TestWalkerIncluded(t *testing.T) {
+	w := &walker{paths: &PathOptions{Include: []string{"db", "logs/app/**"}}}
+	assert.True(t, w.included("db"))
+	assert.True(t, w.included("db/base/1"))
+	assert.True(t, w.included("tenants/a/db"))
+	assert.True(t, w.included("logs/app/today"))
+	assert.False(t, w.included("logs"))
+	assert.False(t, w.included("cache/dbx"))
+}
+
+func TestRelativePath(t *testing.T) {
+	assert.Equal(t, "db/base", relativePath("/data", "/data/db/base"))
+	assert.Equal(t, "db/base", relativePath("/data/", "/data/db/base"))
+	assert.Equal(t, "lost+found", relativePath("/", "/lost+found"))
+	assert.Equal(t, "srv/db", relativePath("/", "/srv/db"))
+
+	w := &walker{paths: &PathOptions{Include: []string{"srv/db"}, Exclude: []string{"lost+found"}}}
+	assert.True(t, w.excluded(relativePath("/", "/lost+found")), "patterns match below a root of /")
+	assert.True(t, w.included(relativePath("/", "/srv/db/base")))
+	assert.False(t, w.included(relativePath("/", "/srv/cache")))
+}
+
+func TestWalkerFixedMarker(t *testing.T) {
+	target := fixpermsTarget{path: "/data", uid: 1001, gid: 1001}
+	full := &walker{paths: &PathOptions{Exclude: []string{"lost+found"}}, maxDepth: -1}
+	assert.Equal(t, "1001:1001 include= exclude=lost+found max-depth=-1 xdev=false", full.fixedMarker(target))
+
+	shallow := &walker{paths: &PathOptions{Exclude: []string{"lost+found"}}, maxDepth: 0}
+	xdev := &walker{paths: &PathOptions{Exclude: []string{"lost+found"}}, maxDepth: -1, xdev: true}
+	assert.NotEqual(t, full.fixedMarker(target), shallow.fixedMarker(target), "a fix of the root only does not stand for a full one")
+	assert.NotEqual(t, full.fixedMarker(target), xdev.fixedMarker(target))
+	assert.Equal(t, (&PathOptions{Exclude: []string{"lost+found"}}).record(), full.recordedPaths(), "the claim records match the webhook options")
+}
+
+func TestEvaluateFixpermsImage(t *testing.T) {
+	tmpl := exporterPod("data", int64Ptr(1001))
+	m := &mutator{config: &MutationConfig{
+		FixpermsImage: "docker.io/malston/volume-permissions-container-injector:v1",
+		Paths:         &PathOptions{Exclude: []string{".snapshot"}},
+	}}
+
+	d, err := m.evaluate(context.TODO(), tmpl)
+	assert.NoError(t, err)
+	c := d.initContainers[0]
+	assert.Equal(t, "docker.io/malston/volume-permissions-container-injector:v1", c.Image)
+	assert.Equal(t, []string{"/usr/local/bin/volume-permissions-container-injector", "fixperms"}, c.Command)
+	assert.Equal(t, []string{"-exclude=.snapshot", "-uid=1001", "-gid=1001", "-mode=", "/data"}, c.Args[:5])
+
+	tmpl.meta.Annotations = map[string]string{admissionWebhookAnnotationStrategyKey: strategyACL}
+	d, err = m.evaluate(context.TODO(), tmpl)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/bitnami/bitnami-shell:10", d.initContainers[0].Image, "the acl strategy needs the shell template")
+}
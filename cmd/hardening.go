@@ -0,0 +1,89 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	capabilityChown       corev1.Capability = "CHOWN"
+	capabilityFowner      corev1.Capability = "FOWNER"
+	capabilityDACOverride corev1.Capability = "DAC_OVERRIDE"
+)
+
+// Hardening restricts the security context of the injected containers so
+// they pass the Pod Security baseline and restricted checks as far as a
+// root container can. Every setting is on unless set to false, and settings
+// the template gives its container are kept.
+type Hardening struct {
+	// DropCapabilities drops all capabilities and adds back those the
+	// strategy needs: CHOWN, FOWNER and DAC_OVERRIDE
+	DropCapabilities *bool `json:"dropCapabilities,omitempty"`
+	// NoPrivilegeEscalation sets allowPrivilegeEscalation to false
+	NoPrivilegeEscalation *bool `json:"noPrivilegeEscalation,omitempty"`
+	// ReadOnlyRootFilesystem mounts the container root filesystem read-only
+	ReadOnlyRootFilesystem *bool `json:"readOnlyRootFilesystem,omitempty"`
+	// RuntimeDefaultSeccomp sets the RuntimeDefault seccomp profile
+	RuntimeDefaultSeccomp *bool `json:"runtimeDefaultSeccomp,omitempty"`
+}
+
+func enabled(setting *bool) bool {
+	return setting == nil || *setting
+}
+
+func (cfg *MutationConfig) hardening() Hardening {
+	if cfg == nil || cfg.Hardening == nil {
+		return Hardening{}
+	}
+	return *cfg.Hardening
+}
+
+// requiredCapabilities returns the capabilities fixing the targets needs:
+// CHOWN to chown, FOWNER to change the mode, ACLs or labels of entries
+// owned by other users and DAC_OVERRIDE to walk directories root may not
+// read. Verifying needs none.
+func requiredCapabilities(targets []*chownTarget, opts *fixOptions) []corev1.Capability {
+	if opts.strategy == strategyVerify {
+		return nil
+	}
+	var caps []corev1.Capability
+	if opts.strategy != strategyACL {
+		caps = append(caps, capabilityChown)
+	}
+	fowner := opts.strategy == strategyACL || opts.relabel != nil
+	for _, t := range targets {
+		fowner = fowner || t.modeChange() != ""
+	}
+	if fowner {
+		caps = append(caps, capabilityFowner)
+	}
+	return append(caps, capabilityDACOverride)
+}
+
+// apply restricts the security context of the injected containers to the
+// capabilities the targets need
+func (h Hardening) apply(containers []corev1.Container, targets []*chownTarget, opts *fixOptions) {
+	for i := range containers {
+		c := &containers[i]
+		if c.SecurityContext == nil {
+			c.SecurityContext = &corev1.SecurityContext{}
+		}
+		sc := c.SecurityContext
+		if enabled(h.DropCapabilities) && sc.Capabilities == nil && (sc.Privileged == nil || !*sc.Privileged) {
+			sc.Capabilities = &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  requiredCapabilities(targets, opts),
+			}
+		}
+		if enabled(h.NoPrivilegeEscalation) && sc.AllowPrivilegeEscalation == nil && (sc.Privileged == nil || !*sc.Privileged) {
+			noEscalation := false
+			sc.AllowPrivilegeEscalation = &noEscalation
+		}
+		if enabled(h.ReadOnlyRootFilesystem) && sc.ReadOnlyRootFilesystem == nil {
+			readOnly := true
+			sc.ReadOnlyRootFilesystem = &readOnly
+		}
+		if enabled(h.RuntimeDefaultSeccomp) && sc.SeccompProfile == nil {
+			sc.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRequiredCapabilities(t *testing.T) {
+	plain := []*chownTarget{{uid: 1001, gid: 1001, mountPath: "/data"}}
+	groupWritable := []*chownTarget{{uid: 1001, gid: 1001, mountPath: "/data", groupWritable: true}}
+	tests := []struct {
+		name    string
+		targets []*chownTarget
+		opts    *fixOptions
+		want    []corev1.Capability
+	}{
+		{name: "chown", targets: plain, opts: &fixOptions{}, want: []corev1.Capability{capabilityChown, capabilityDACOverride}},
+		{name: "chown and chmod", targets: groupWritable, opts: &fixOptions{}, want: []corev1.Capability{capabilityChown, capabilityFowner, capabilityDACOverride}},
+		{name: "relabel", targets: plain, opts: &fixOptions{relabel: &selinuxRelabel{}}, want: []corev1.Capability{capabilityChown, capabilityFowner, capabilityDACOverride}},
+		{name: "acl", targets: plain, opts: &fixOptions{strategy: strategyACL}, want: []corev1.Capability{capabilityFowner, capabilityDACOverride}},
+		{name: "verify", targets: plain, opts: &fixOptions{strategy: strategyVerify}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, requiredCapabilities(tt.targets, tt.opts), tt.name)
+	}
+}
+
+func TestHardeningApply(t *testing.T) {
+	targets := []*chownTarget{{uid: 1001, gid: 1001, mountPath: "/data"}}
+	readOnly := false
+	containers := []corev1.Container{
+		{Name: "default"},
+		{Name: "template", SecurityContext: &corev1.SecurityContext{
+			Capabilities:           &corev1.Capabilities{Add: []corev1.Capability{"SYS_ADMIN"}},
+			ReadOnlyRootFilesystem: &readOnly,
+		}},
+	}
+	Hardening{}.apply(containers, targets, &fixOptions{})
+
+	sc := containers[0].SecurityContext
+	assert.Equal(t, &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}, Add: []corev1.Capability{capabilityChown, capabilityDACOverride}}, sc.Capabilities)
+	assert.False(t, *sc.AllowPrivilegeEscalation)
+	assert.True(t, *sc.ReadOnlyRootFilesystem)
+	assert.Equal(t, corev1.SeccompProfileTypeRuntimeDefault, sc.SeccompProfile.Type)
+
+	sc = containers[1].SecurityContext
+	assert.Equal(t, []corev1.Capability{"SYS_ADMIN"}, sc.Capabilities.Add, "the template settings are kept")
+	assert.False(t, *sc.ReadOnlyRootFilesystem)
+	assert.NotNil(t, sc.SeccompProfile)
+
+	off := false
+	containers = []corev1.Container{{Name: "off"}}
+	Hardening{DropCapabilities: &off, NoPrivilegeEscalation: &off, ReadOnlyRootFilesystem: &off, RuntimeDefaultSeccomp: &off}.apply(containers, targets, &fixOptions{})
+	assert.Equal(t, &corev1.SecurityContext{}, containers[0].SecurityContext)
+}
+
+func TestEvaluateHardening(t *testing.T) {
+	tmpl := &podTemplate{
+		meta: &metav1.ObjectMeta{Name: "app", Namespace: "apps", Annotations: map[string]string{admissionWebhookAnnotationStrategyKey: strategyACL}},
+		spec: &corev1.PodSpec{
+			SecurityContext: &corev1.PodSecurityContext{FSGroup: int64Ptr(1001)},
+			Containers: []corev1.Container{{
+				Name:         "app",
+				VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+			}},
+			Volumes: []corev1.Volume{
+				{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+			},
+		},
+	}
+	d, err := (&mutator{}).evaluate(context.TODO(), tmpl)
+	assert.NoError(t, err)
+	sc := d.initContainers[0].SecurityContext
+	assert.Equal(t, int64(0), *sc.RunAsUser)
+	assert.Equal(t, []corev1.Capability{capabilityFowner, capabilityDACOverride}, sc.Capabilities.Add)
+}
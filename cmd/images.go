@@ -0,0 +1,704 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// imageConfigPreset names the presets derived from the config of an
+	// image in the ownership-presets annotation
+	imageConfigPreset = "image-config"
+
+	defaultImageInspectionTimeout = 2 * time.Second
+	// maxCachedImages bounds the image users cached by digest
+	maxCachedImages = 1024
+	// maxRegistryResponse bounds the manifests, configs and tokens read from
+	// registries
+	maxRegistryResponse = 4 << 20
+
+	dockerHub         = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// manifestMediaTypes are the manifests and manifest lists the registry
+// client understands, Docker and OCI
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// ImageInspection looks up the user in the config of the container images
+// when neither the pod nor an ownership preset gives a container an owner
+type ImageInspection struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Timeout bounds all the lookups of an admission, 2s when unset. Pods
+	// whose images are not resolved in time get no owner from them.
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// InsecureRegistries are registry host patterns, * matching any run of
+	// characters, reached over plain http
+	InsecureRegistries []string `json:"insecureRegistries,omitempty"`
+	// Registries are the host patterns of the registries and token services
+	// the webhook may reach, all of them when unset. Loopback, link-local
+	// and cluster-internal hosts are only reached when listed.
+	Registries []string `json:"registries,omitempty"`
+}
+
+func (cfg *MutationConfig) imageInspectionTimeout() time.Duration {
+	if cfg == nil || cfg.ImageInspection == nil || cfg.ImageInspection.Timeout == nil {
+		return defaultImageInspectionTimeout
+	}
+	return cfg.ImageInspection.Timeout.Duration
+}
+
+// imageReference is a parsed image reference, registry is the host serving
+// the registry API
+type imageReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseImageReference parses an image reference the way the container
+// runtimes do: a first component holding a dot, a colon or localhost names
+// the registry, Docker Hub is used otherwise
+func parseImageReference(image string) imageReference {
+	ref := imageReference{}
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, ref.digest = image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, ref.tag = image[:i], image[i+1:]
+	}
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = "latest"
+	}
+	ref.registry, ref.repository = dockerHub, image
+	if i := strings.Index(image, "/"); i >= 0 {
+		if host := image[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.registry, ref.repository = host, image[i+1:]
+		}
+	}
+	if ref.registry == dockerHub || ref.registry == "index.docker.io" {
+		ref.registry = dockerHubRegistry
+		if !strings.Contains(ref.repository, "/") {
+			ref.repository = "library/" + ref.repository
+		}
+	}
+	return ref
+}
+
+// reference returns the tag or digest naming the manifest
+func (r imageReference) reference() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
+
+// registryCredential authenticates to a registry, the zero value is
+// anonymous
+type registryCredential struct {
+	username string
+	password string
+}
+
+// imageConfig holds the part of the image config the webhook uses
+type imageConfig struct {
+	User string
+}
+
+// registryClient fetches image configs, a fake one serves the tests
+type registryClient interface {
+	// Digest resolves the reference to the digest of its manifest
+	Digest(ctx context.Context, ref imageReference, cred registryCredential) (string, error)
+	// Config returns the config of the image with the manifest digest
+	Config(ctx context.Context, ref imageReference, digest string, cred registryCredential) (*imageConfig, error)
+}
+
+// imageUser is the owner an image config gives its containers
+type imageUser struct {
+	uid int64
+	gid int64
+	// ok is false when the config gives no usable owner, like root or a
+	// user name
+	ok bool
+}
+
+// parseImageUser parses the User of an image config. Only numeric users
+// resolve, the group defaults to 0 like the runtimes do for users missing
+// from the image passwd file. Root needs no fix.
+func parseImageUser(user string) imageUser {
+	parts := strings.SplitN(user, ":", 2)
+	uid, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || uid <= 0 {
+		return imageUser{}
+	}
+	var gid int64
+	if len(parts) == 2 {
+		if gid, err = strconv.ParseInt(parts[1], 10, 64); err != nil || gid < 0 {
+			return imageUser{}
+		}
+	}
+	return imageUser{uid: uid, gid: gid, ok: true}
+}
+
+// imageInspector resolves the users of images through a registry client and
+// caches them by manifest digest
+type imageInspector struct {
+	client  registryClient
+	timeout time.Duration
+
+	mu    sync.Mutex
+	users map[string]imageUser
+}
+
+func newImageInspector(client registryClient, timeout time.Duration) *imageInspector {
+	return &imageInspector{client: client, timeout: timeout, users: map[string]imageUser{}}
+}
+
+// newImageInspectorFor returns the inspector of the configuration, nil when
+// image inspection is off
+func newImageInspectorFor(cfg *MutationConfig) *imageInspector {
+	if cfg == nil || cfg.ImageInspection == nil || !cfg.ImageInspection.Enabled {
+		return nil
+	}
+	client := &httpRegistryClient{
+		insecure:   cfg.ImageInspection.InsecureRegistries,
+		registries: cfg.ImageInspection.Registries,
+	}
+	client.client = &http.Client{
+		Timeout: cfg.imageInspectionTimeout(),
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         client.dial,
+			TLSHandshakeTimeout: cfg.imageInspectionTimeout(),
+		},
+	}
+	return newImageInspector(client, cfg.imageInspectionTimeout())
+}
+
+// userOf returns the owner the config of the image gives its containers
+func (i *imageInspector) userOf(ctx context.Context, image string, creds map[string]registryCredential) (imageUser, error) {
+	ref := parseImageReference(image)
+	cred := creds[ref.registry]
+	digest, err := i.client.Digest(ctx, ref, cred)
+	if err != nil {
+		return imageUser{}, err
+	}
+	i.mu.Lock()
+	user, ok := i.users[digest]
+	i.mu.Unlock()
+	if ok {
+		return user, nil
+	}
+	config, err := i.client.Config(ctx, ref, digest, cred)
+	if err != nil {
+		return imageUser{}, err
+	}
+	user = parseImageUser(config.User)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.users) >= maxCachedImages {
+		for d := range i.users {
+			delete(i.users, d)
+			break
+		}
+	}
+	i.users[digest] = user
+	return user, nil
+}
+
+// declaresOwner reports whether the pod or container security context gives
+// the container an owner
+func declaresOwner(podSecurityContext *corev1.PodSecurityContext, c *corev1.Container) bool {
+	if c.SecurityContext != nil && (c.SecurityContext.RunAsUser != nil || c.SecurityContext.RunAsGroup != nil) {
+		return true
+	}
+	return podSecurityContext != nil && (podSecurityContext.RunAsUser != nil || podSecurityContext.RunAsGroup != nil || podSecurityContext.FSGroup != nil)
+}
+
+// imagePresets looks up the users of the images of the containers that
+// mount eligible volumes and get no owner from the pod or a preset, and
+// returns them as presets matching those images. Lookups failing or not
+// done in time are reported as warnings.
+func (m *mutator) imagePresets(ctx context.Context, tmpl *podTemplate, containers []corev1.Container, eligible func(name string) bool, presets []OwnershipPreset) ([]OwnershipPreset, []string) {
+	if m.images == nil {
+		return nil, nil
+	}
+	var images []string
+	for i := range containers {
+		c := &containers[i]
+		if declaresOwner(tmpl.spec.SecurityContext, c) || presetFor(presets, c.Image) != nil || !mountsEligible(c, eligible) {
+			continue
+		}
+		if !containsString(images, c.Image) {
+			images = append(images, c.Image)
+		}
+	}
+	if len(images) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.images.timeout)
+	defer cancel()
+	creds, err := m.pullCredentials(ctx, tmpl)
+	if err != nil {
+		glog.Warningf("Could not read the image pull secrets of %s/%s: %v", tmpl.meta.Namespace, tmpl.meta.Name, err)
+	}
+	var resolved []OwnershipPreset
+	var warnings []string
+	for _, image := range images {
+		user, err := m.images.userOf(ctx, image, creds)
+		if err != nil {
+			glog.Warningf("Could not look up the user of image %s: %v", image, err)
+			warnings = append(warnings, fmt.Sprintf("could not look up the user of image %s, the webhook logs tell why", image))
+			continue
+		}
+		if !user.ok {
+			continue
+		}
+		glog.Infof("Image %s runs as %d:%d", image, user.uid, user.gid)
+		resolved = append(resolved, OwnershipPreset{Name: imageConfigPreset, Images: []string{image}, UID: user.uid, GID: user.gid})
+	}
+	return resolved, warnings
+}
+
+func mountsEligible(c *corev1.Container, eligible func(name string) bool) bool {
+	for _, v := range c.VolumeMounts {
+		if !v.ReadOnly && eligible(v.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pullCredentials reads the registry credentials of the pod image pull
+// secrets, keyed by registry host
+func (m *mutator) pullCredentials(ctx context.Context, tmpl *podTemplate) (map[string]registryCredential, error) {
+	creds := map[string]registryCredential{}
+	if m.clientset == nil {
+		return creds, nil
+	}
+	for _, ref := range tmpl.spec.ImagePullSecrets {
+		secret, err := m.clientset.CoreV1().Secrets(tmpl.meta.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return creds, err
+		}
+		if err := addDockerConfig(creds, secret); err != nil {
+			return creds, fmt.Errorf("secret %s: %v", ref.Name, err)
+		}
+	}
+	return creds, nil
+}
+
+// dockerConfigEntry is a registry entry of a docker config
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// addDockerConfig adds the credentials of a dockerconfigjson or dockercfg
+// secret, the first secret naming a registry wins like in the kubelet
+func addDockerConfig(creds map[string]registryCredential, secret *corev1.Secret) error {
+	var auths map[string]dockerConfigEntry
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var config struct {
+			Auths map[string]dockerConfigEntry `json:"auths"`
+		}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return err
+		}
+		auths = config.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", secret.Type)
+	}
+	for server, entry := range auths {
+		cred := registryCredential{username: entry.Username, password: entry.Password}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return fmt.Errorf("registry %s: %v", server, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("registry %s: auth is not user:password", server)
+			}
+			cred = registryCredential{username: parts[0], password: parts[1]}
+		}
+		registry := registryHost(server)
+		if _, ok := creds[registry]; !ok {
+			creds[registry] = cred
+		}
+	}
+	return nil
+}
+
+// registryHost strips the scheme and path of a docker config server, the
+// Docker Hub aliases map to its registry
+func registryHost(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	switch host {
+	case dockerHub, "index.docker.io":
+		return dockerHubRegistry
+	}
+	return host
+}
+
+// dockerHubAuth is the token service of Docker Hub, trusted with its
+// credentials
+const dockerHubAuth = "auth.docker.io"
+
+// httpRegistryClient talks the registry HTTP API v2, authenticating with
+// basic auth or bearer tokens as the registry asks
+type httpRegistryClient struct {
+	client *http.Client
+	// insecure are the registry host patterns reached over plain http
+	insecure []string
+	// registries are the host patterns the client may reach, any when empty
+	registries []string
+}
+
+// allowed reports whether the client may send requests to the host
+func (c *httpRegistryClient) allowed(host string) error {
+	if len(c.registries) > 0 && !c.listed(host) {
+		return fmt.Errorf("%s is not one of the image inspection registries", host)
+	}
+	if !c.listed(host) && clusterInternalHost(host) {
+		return fmt.Errorf("%s is cluster-internal, list it in the image inspection registries to reach it", host)
+	}
+	return nil
+}
+
+func (c *httpRegistryClient) listed(host string) bool {
+	return matchAny(c.registries, host)
+}
+
+// clusterInternalHost reports whether the host names a cluster service
+func clusterInternalHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host == "kubernetes" || strings.HasPrefix(host, "kubernetes.default") ||
+		strings.HasSuffix(host, ".svc") || strings.HasSuffix(host, ".cluster.local")
+}
+
+// internalIP reports whether the address is one the registries of images
+// have no business on: loopback, link-local like the cloud metadata
+// services, unspecified, multicast or the API server service
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	apiServer := net.ParseIP(os.Getenv("KUBERNETES_SERVICE_HOST"))
+	return apiServer != nil && apiServer.Equal(ip)
+}
+
+// dial connects to the address unless it resolves to an internal address and
+// is not listed in the registries. It dials the checked address so the name
+// cannot resolve elsewhere in between.
+func (c *httpRegistryClient) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if c.listed(address) || c.listed(host) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if internalIP(addr.IP) {
+			return nil, fmt.Errorf("%s resolves to the internal address %s, list it in the image inspection registries to reach it", host, addr.IP)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no address", host)
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(addrs[0].IP.String(), port))
+}
+
+func (c *httpRegistryClient) url(ref imageReference, kind, reference string) string {
+	scheme := "https"
+	if matchAny(c.insecure, ref.registry) {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s/%s", scheme, ref.registry, ref.repository, kind, reference)
+}
+
+func (c *httpRegistryClient) Digest(ctx context.Context, ref imageReference, cred registryCredential) (string, error) {
+	if ref.digest != "" {
+		return ref.digest, nil
+	}
+	resp, err := c.get(ctx, http.MethodHead, c.url(ref, "manifests", ref.tag), ref, cred)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	// registries may leave the digest out of HEAD responses, digest the
+	// manifest itself then
+	body, err := c.read(ctx, c.url(ref, "manifests", ref.tag), ref, cred)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+}
+
+func (c *httpRegistryClient) Config(ctx context.Context, ref imageReference, digest string, cred registryCredential) (*imageConfig, error) {
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	body, err := c.read(ctx, c.url(ref, "manifests", digest), ref, cred)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", digest, err)
+	}
+	// a manifest list points to the image of the platform of the nodes,
+	// assumed to be the one the webhook runs on
+	if len(manifest.Manifests) > 0 {
+		platform := ""
+		for _, m := range manifest.Manifests {
+			if m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+				platform = m.Digest
+				break
+			}
+			if platform == "" && m.Platform.OS == "linux" {
+				platform = m.Digest
+			}
+		}
+		if platform == "" {
+			return nil, fmt.Errorf("manifest list %s has no linux image", digest)
+		}
+		return c.Config(ctx, ref, platform, cred)
+	}
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest %s has no config", digest)
+	}
+
+	var config struct {
+		Config imageConfig `json:"config"`
+	}
+	body, err = c.read(ctx, c.url(ref, "blobs", manifest.Config.Digest), ref, cred)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, fmt.Errorf("config %s: %v", manifest.Config.Digest, err)
+	}
+	return &config.Config, nil
+}
+
+func (c *httpRegistryClient) read(ctx context.Context, u string, ref imageReference, cred registryCredential) ([]byte, error) {
+	resp, err := c.get(ctx, http.MethodGet, u, ref, cred)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxRegistryResponse))
+}
+
+// get sends the request, answering the authentication challenge of the
+// registry once. The response has a successful status.
+func (c *httpRegistryClient) get(ctx context.Context, method, u string, ref imageReference, cred registryCredential) (*http.Response, error) {
+	if err := c.allowed(ref.registry); err != nil {
+		return nil, err
+	}
+	authorization := ""
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if authorization, err = c.authorize(ctx, challenge, ref, cred); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+// authorize returns the Authorization header answering the challenge
+func (c *httpRegistryClient) authorize(ctx context.Context, challenge string, ref imageReference, cred registryCredential) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if cred.username == "" {
+			return "", fmt.Errorf("registry %s needs credentials", ref.registry)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(cred.username+":"+cred.password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("registry %s asks for unsupported authentication %q", ref.registry, challenge)
+	}
+
+	realm, err := c.realm(params["realm"], ref)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", "repository:"+ref.repository+":pull")
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	// the pull secret of a registry only goes to its own token service
+	if cred.username != "" && (realm.Host == ref.registry || (ref.registry == dockerHubRegistry && realm.Host == dockerHubAuth) || c.listed(realm.Host)) {
+		req.SetBasicAuth(cred.username, cred.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token of registry %s: %s", ref.registry, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRegistryResponse)).Decode(&token); err != nil {
+		return "", fmt.Errorf("token of registry %s: %v", ref.registry, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// realm checks the token service a registry sends the client to: it is
+// reached over https unless both it and the registry are insecure, and like
+// the registry it must be allowed
+func (c *httpRegistryClient) realm(realm string, ref imageReference) (*url.URL, error) {
+	u, err := url.Parse(realm)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("registry %s asks for a token from the invalid realm %q", ref.registry, realm)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !matchAny(c.insecure, ref.registry) || !matchAny(c.insecure, u.Host) {
+			return nil, fmt.Errorf("registry %s asks for a token over plain http from %s, which is not an insecure registry", ref.registry, u.Host)
+		}
+	default:
+		return nil, fmt.Errorf("registry %s asks for a token from the unsupported realm %q", ref.registry, realm)
+	}
+	if err := c.allowed(u.Host); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return parts[0], params
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseImageReference(t *testing.T) {
+	assert.Equal(t, imageReference{registry: "registry-1.docker.io", repository: "library/postgres", tag: "10.16-alpine"}, parseImageReference("postgres:10.16-alpine"))
+	assert.Equal(t, imageReference{registry: "registry-1.docker.io", repository: "minio/minio", tag: "latest"}, parseImageReference("minio/minio"))
+	assert.Equal(t, imageReference{registry: "registry-1.docker.io", repository: "bitnami/redis", tag: "6"}, parseImageReference("docker.io/bitnami/redis:6"))
+	assert.Equal(t, imageReference{registry: "registry:5000", repository: "team/app", tag: "v1", digest: "sha256:7b8b"}, parseImageReference("registry:5000/team/app:v1@sha256:7b8b"))
+	assert.Equal(t, imageReference{registry: "localhost", repository: "app", tag: "latest"}, parseImageReference("localhost/app"))
+}
+
+func TestParseImageUser(t *testing.T) {
+	assert.Equal(t, imageUser{uid: 1001, gid: 0, ok: true}, parseImageUser("1001"))
+	assert.Equal(t, imageUser{uid: 70, gid: 70, ok: true}, parseImageUser("70:70"))
+	assert.False(t, parseImageUser("").ok, "root")
+	assert.False(t, parseImageUser("0:0").ok, "root")
+	assert.False(t, parseImageUser("postgres").ok, "names need the image passwd file")
+	assert.False(t, parseImageUser("1001:staff").ok)
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/postgres:pull"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/postgres:pull",
+	}, params)
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	assert.Equal(t, "Basic", scheme)
+	assert.Equal(t, "registry", params["realm"])
+}
+
+func TestAddDockerConfig(t *testing.T) {
+	creds := map[string]registryCredential{}
+	assert.NoError(t, addDockerConfig(creds, &corev1.Secret{
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{
+			"https://index.docker.io/v1/":{"auth":"aHViOnNlY3JldA=="},
+			"registry.example.com":{"username":"ci","password":"token"}}}`)},
+	}))
+	assert.NoError(t, addDockerConfig(creds, &corev1.Secret{
+		Type: corev1.SecretTypeDockercfg,
+		Data: map[string][]byte{corev1.DockerConfigKey: []byte(`{"registry.example.com":{"username":"other","password":"ignored"}}`)},
+	}))
+	assert.Equal(t, map[string]registryCredential{
+		"registry-1.docker.io": {username: "hub", password: "secret"},
+		"registry.example.com": {username: "ci", password: "token"},
+	}, creds)
+	assert.Error(t, addDockerConfig(creds, &corev1.Secret{Type: corev1.SecretTypeOpaque}))
+}
+
+// testRegistry serves a multi-platform image config through the registry API,
+// handing out tokens for the given credentials only
+type testRegistry struct {
+	*httptest.Server
+	user          string
+	configFetches int32
+}
+
+func newTestRegistry(t *testing.T, username, password, user string) *testRegistry {
+	r := &testRegistry{}
+	config, _ := json.Marshal(map[string]interface{}{"architecture": runtime.GOARCH, "config": map[string]string{"User": user}})
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]string{"digest": configDigest},
+	})
+	manifestDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	index, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests": []map[string]interface{}{
+			{"digest": "sha256:windows", "platform": map[string]string{"os": "windows", "architecture": runtime.GOARCH}},
+			{"digest": manifestDigest, "platform": map[string]string{"os": "linux", "architecture": runtime.GOARCH}},
+		},
+	})
+	indexDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(index))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		if !ok || u != username || p != password || req.URL.Query().Get("scope") != "repository:team/app:pull" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token":"pull-token"}`)
+	})
+	mux.HandleFunc("/v2/team/app/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer pull-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, r.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch strings.TrimPrefix(req.URL.Path, "/v2/team/app/") {
+		case "manifests/v1", "manifests/" + indexDigest:
+			w.Header().Set("Docker-Content-Digest", indexDigest)
+			w.Write(index)
+		case "manifests/" + manifestDigest:
+			w.Write(manifest)
+		case "blobs/" + configDigest:
+			atomic.AddInt32(&r.configFetches, 1)
+			w.Write(config)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+	r.Server = httptest.NewServer(mux)
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+func TestImageInspector(t *testing.T) {
+	registry := newTestRegistry(t, "ci", "token", "1001:1001")
+	client := &httpRegistryClient{client: &http.Client{}, insecure: []string{registry.host()}}
+	inspector := newImageInspector(client, time.Second)
+	image := registry.host() + "/team/app:v1"
+
+	_, err := inspector.userOf(context.TODO(), image, nil)
+	assert.Error(t, err, "anonymous pulls are refused")
+
+	creds := map[string]registryCredential{registry.host(): {username: "ci", password: "token"}}
+	for i := 0; i < 2; i++ {
+		user, err := inspector.userOf(context.TODO(), image, creds)
+		assert.NoError(t, err)
+		assert.Equal(t, imageUser{uid: 1001, gid: 1001, ok: true}, user)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&registry.configFetches), "configs are cached by digest")
+}
+
+func TestEvaluateImageInspection(t *testing.T) {
+	registry := newTestRegistry(t, "ci", "token", "1001")
+	secret, _ := json.Marshal(map[string]interface{}{"auths": map[string]interface{}{
+		registry.URL: map[string]string{"username": "ci", "password": "token"},
+	}})
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "pull", Namespace: "apps"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: secret},
+	})
+	cfg := &MutationConfig{ImageInspection: &ImageInspection{Enabled: true, InsecureRegistries: []string{"127.0.0.1:*"}, Registries: []string{"127.0.0.1:*"}}}
+	tmpl := func(image string) *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+			spec: &corev1.PodSpec{
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "pull"}},
+				Containers: []corev1.Container{{
+					Name:         "app",
+					Image:        image,
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				}},
+				Volumes: []corev1.Volume{
+					{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				},
+			},
+		}
+	}
+
+	m := &mutator{config: cfg, clientset: clientset, images: newImageInspectorFor(cfg)}
+	d, err := m.evaluate(context.TODO(), tmpl(registry.host()+"/team/app:v1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1001:0 /data"}, targetStrings(d.targets))
+	assert.Equal(t, "app="+imageConfigPreset, d.annotations[admissionWebhookAnnotationPresetsKey])
+
+	d, err = m.evaluate(context.TODO(), tmpl(registry.host()+"/team/missing:v1"))
+	assert.NoError(t, err)
+	assert.False(t, d.inject)
+
+	unlisted := &MutationConfig{ImageInspection: &ImageInspection{Enabled: true, InsecureRegistries: []string{"127.0.0.1:*"}}}
+	d, err = (&mutator{config: unlisted, clientset: clientset, images: newImageInspectorFor(unlisted)}).evaluate(context.TODO(), tmpl(registry.host()+"/team/app:v1"))
+	assert.NoError(t, err)
+	assert.False(t, d.inject, "loopback registries are only reached when listed")
+	assert.Equal(t, []string{"could not look up the user of image " + registry.host() + "/team/app:v1, the webhook logs tell why"}, d.warnings)
+
+	d, err = m.evaluate(context.TODO(), tmpl("docker.io/bitnami/redis:6"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1001:1001 /data"}, targetStrings(d.targets), "presets are not looked up")
+}
+
+func TestRegistryRealm(t *testing.T) {
+	ref := imageReference{registry: "registry.example.com", repository: "team/app"}
+	c := &httpRegistryClient{insecure: []string{"registry.internal:5000"}}
+	for realm, ok := range map[string]bool{
+		"https://registry.example.com/token":                true,
+		"https://auth.example.com/token":                    true,
+		"http://registry.example.com/token":                 false,
+		"file:///etc/passwd":                                false,
+		"/token":                                            false,
+		"https://kubernetes.default.svc/api":                false,
+		"https://registry.registry.svc.cluster.local/token": false,
+	} {
+		_, err := c.realm(realm, ref)
+		assert.Equal(t, ok, err == nil, realm)
+	}
+	_, err := c.realm("http://registry.internal:5000/token", imageReference{registry: "registry.internal:5000"})
+	assert.NoError(t, err, "insecure registries may use plain http")
+
+	c.registries = []string{"registry.example.com"}
+	_, err = c.realm("https://auth.example.com/token", ref)
+	assert.Error(t, err, "unlisted token services are refused")
+}
+
+func TestRegistryCredentialsStayWithTheRegistry(t *testing.T) {
+	var sentCredentials int32
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, _, ok := req.BasicAuth(); ok {
+			atomic.AddInt32(&sentCredentials, 1)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer tokens.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token"`, tokens.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer registry.Close()
+
+	c := &httpRegistryClient{client: &http.Client{}, insecure: []string{"127.0.0.1:*"}}
+	ref := parseImageReference(strings.TrimPrefix(registry.URL, "http://") + "/team/app:v1")
+	_, err := c.Digest(context.TODO(), ref, registryCredential{username: "ci", password: "token"})
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&sentCredentials), "the pull secret is not sent to another host")
+}
+
+func TestInternalIP(t *testing.T) {
+	for ip, internal := range map[string]bool{
+		"127.0.0.1":       true,
+		"169.254.169.254": true,
+		"fe80::1":         true,
+		"0.0.0.0":         true,
+		"10.0.12.4":       false,
+		"52.1.2.3":        false,
+	} {
+		assert.Equal(t, internal, internalIP(net.ParseIP(ip)), ip)
+	}
+}
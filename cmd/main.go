@@ -11,11 +11,46 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		// subcommands own their flags, parse an empty command line so glog
+		// does not complain about logging before flag.Parse
+		_ = flag.CommandLine.Parse(nil)
+		switch os.Args[1] {
+		case "mutate":
+			if err := runMutateCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "mutate: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "fixperms":
+			if err := runFixpermsCommand(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "fixperms: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "controller":
+			if err := runControllerCommand(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "controller: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "test":
+			if err := runTestCommand(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "test: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var parameters Parameters
 
 	// get command line parameters
@@ -23,6 +58,8 @@ func main() {
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
 	flag.StringVar(&parameters.initContainerCfgFile, "initContainerCfgFile", "/etc/webhook/config/initcontainerconfig.yaml", "File containing the mutation configuration.")
+	flag.BoolVar(&parameters.podWatcher, "podWatcher", false, "Report the outcome of the injected containers through Events, metrics and logs, from the replica holding the pod watcher lease.")
+	flag.BoolVar(&parameters.claimController, "claimController", false, "Also run the claim controller fixing bound claims with Jobs.")
 	flag.Parse()
 
 	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
@@ -30,18 +67,38 @@ func main() {
 		glog.Errorf("Failed to load key pair: %v", err)
 	}
 
+	mutationConfig, err := loadMutationConfig(parameters.initContainerCfgFile)
+	if err != nil {
+		glog.Errorf("Failed to load mutation configuration: %v", err)
+		os.Exit(1)
+	}
+
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		panic(err.Error())
 	}
 
 	clientset := kubernetes.NewForConfigOrDie(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// admissions read the namespace defaults from the informer cache rather
+	// than the API server
+	factory := informers.NewSharedInformerFactory(clientset, 10*time.Minute)
+	namespaces := factory.Core().V1().Namespaces()
 	wh := &WebhookServer{
 		server: &http.Server{
 			Addr:      fmt.Sprintf(":%v", parameters.port),
 			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
 		},
-		clientset: clientset,
+		clientset:  clientset,
+		namespaces: namespaces.Lister(),
+		config:     mutationConfig,
+		images:     newImageInspectorFor(mutationConfig),
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), namespaces.Informer().HasSynced) {
+		glog.Errorf("Failed to sync the namespace cache")
+		os.Exit(1)
 	}
 
 	// define http server and server handler
@@ -49,6 +106,26 @@ func main() {
 	mux.HandleFunc("/mutate", wh.serve)
 	wh.server.Handler = mux
 
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	// only the replica holding the pod watcher lease reports, the others
+	// take over when it goes away
+	if parameters.podWatcher {
+		watcher := newPodWatcher(newEventRecorder(clientset))
+		mux.HandleFunc("/metrics", watcher.metrics.serve)
+		go func() {
+			for ctx.Err() == nil {
+				if err := runLeading(ctx, clientset, podWatcherLeaseName, os.Getenv("POD_NAMESPACE"), identity, func(ctx context.Context) {
+					watcher.run(ctx, clientset, 10*time.Minute)
+				}); err != nil {
+					glog.Warningf("Pod watcher stopped: %v", err)
+				}
+			}
+		}()
+	}
+
 	// start webhook server in new rountine
 	go func() {
 		if err := wh.server.ListenAndServeTLS("", ""); err != nil {
@@ -56,10 +133,23 @@ func main() {
 		}
 	}()
 
+	// run the claim controller alongside, only the replica holding its lease
+	// starts Jobs
+	if parameters.claimController {
+		c := &claimController{config: mutationConfig, clientset: clientset}
+		go func() {
+			if err := runLeading(ctx, clientset, controllerLeaseName, os.Getenv("POD_NAMESPACE"), identity, func(ctx context.Context) { c.run(ctx, 10*time.Minute) }); err != nil {
+				glog.Errorf("Claim controller stopped: %v", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// listening OS shutdown singal
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
+	cancel()
 
 	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
 	wh.server.Shutdown(context.Background())
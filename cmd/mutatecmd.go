@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/ghodss/yaml"
+)
+
+const (
+	outputObject = "object"
+	outputPatch  = "patch"
+)
+
+var yamlDocumentSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// runMutateCommand applies the webhook mutation to the manifests read from a
+// file or stdin and prints either the mutated objects or the JSON patches
+func runMutateCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("mutate", flag.ContinueOnError)
+	filename := fs.String("f", "-", "File containing the manifests to mutate, - reads from stdin.")
+	output := fs.String("o", outputObject, "Output format, one of: object, patch.")
+	configFile := fs.String("config", "", "File containing the mutation configuration, defaults are used when empty.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := loadMutationConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if *output != outputObject && *output != outputPatch {
+		return fmt.Errorf("unknown output format %q, expect %s or %s", *output, outputObject, outputPatch)
+	}
+
+	data, err := readInput(*filename, stdin)
+	if err != nil {
+		return err
+	}
+
+	first := true
+	for _, doc := range splitYAMLDocuments(data) {
+		mutated, patch, err := mutateManifest(doc, cfg)
+		if err != nil {
+			return err
+		}
+		if *output == outputPatch {
+			if patch == nil {
+				continue
+			}
+			fmt.Fprintf(stdout, "# %s\n%s\n", describeManifest(doc), patch)
+			continue
+		}
+		if !first {
+			fmt.Fprintln(stdout, "---")
+		}
+		first = false
+		out, err := yaml.JSONToYAML(mutated)
+		if err != nil {
+			return err
+		}
+		if _, err := stdout.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readInput(filename string, stdin io.Reader) ([]byte, error) {
+	if filename == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(filename)
+}
+
+func splitYAMLDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	for _, doc := range yamlDocumentSeparator.Split(string(data), -1) {
+		if len(bytes.TrimSpace([]byte(doc))) == 0 {
+			continue
+		}
+		docs = append(docs, []byte(doc))
+	}
+	return docs
+}
+
+// mutateManifest returns the manifest as JSON with the mutation applied and the
+// patch that produced it. Kinds without a pod template are returned unchanged
+// with a nil patch.
+func mutateManifest(doc []byte, cfg *MutationConfig) ([]byte, []byte, error) {
+	raw, err := yaml.YAMLToJSON(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj, _, err := deserializer.Decode(raw, nil, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", describeManifest(doc), err)
+		return raw, nil, nil
+	}
+	tmpl, err := podTemplateFor(obj)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", describeManifest(doc), err)
+		return raw, nil, nil
+	}
+
+	m := &mutator{config: cfg}
+	patchBytes, d, err := m.mutatePodTemplate(context.TODO(), tmpl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", describeManifest(doc), err)
+	}
+	for _, w := range d.warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", describeManifest(doc), w)
+	}
+	if patchBytes == nil {
+		return raw, nil, nil
+	}
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	mutated, err := patch.Apply(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("applying patch to %s: %v", describeManifest(doc), err)
+	}
+	return mutated, patchBytes, nil
+}
+
+func describeManifest(doc []byte) string {
+	var m struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+	}
+	if err := yaml.Unmarshal(doc, &m); err != nil {
+		return "manifest"
+	}
+	if m.Metadata.Namespace != "" {
+		return fmt.Sprintf("%s %s/%s", m.Kind, m.Metadata.Namespace, m.Metadata.Name)
+	}
+	return fmt.Sprintf("%s %s", m.Kind, m.Metadata.Name)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestRunMutateCommand(t *testing.T) {
+	t.Run("object output", func(t *testing.T) {
+		var out bytes.Buffer
+		err := runMutateCommand([]string{"-f", "../examples/sentry-redis-master-0.yaml"}, nil, &out)
+		assert.NoError(t, err)
+
+		var pod corev1.Pod
+		assert.NoError(t, yaml.Unmarshal(out.Bytes(), &pod))
+		if assert.Len(t, pod.Spec.InitContainers, 1) {
+			assert.Equal(t, "volume-permissions", pod.Spec.InitContainers[0].Name)
+			assert.Equal(t, []string{"/bin/bash", "-ec", "chown -R 1001:1001 /bitnami/redis/data"}, pod.Spec.InitContainers[0].Command)
+		}
+		assert.Equal(t, "injected", pod.Annotations[admissionWebhookAnnotationStatusKey])
+		assert.Equal(t, "sentry-pro", pod.Annotations["kots.io/app-slug"])
+	})
+
+	t.Run("patch output", func(t *testing.T) {
+		data, err := ioutil.ReadFile("../examples/sentry-redis-sts.yaml")
+		assert.NoError(t, err)
+
+		var out bytes.Buffer
+		err = runMutateCommand([]string{"-o", "patch"}, bytes.NewReader(data), &out)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(out.String(), "# StatefulSet sentry-pro/sentry-redis-master\n"))
+		assert.Contains(t, out.String(), `"path":"/spec/template/spec/initContainers"`)
+		assert.NotContains(t, out.String(), "Secret")
+	})
+
+	t.Run("already injected", func(t *testing.T) {
+		var out bytes.Buffer
+		err := runMutateCommand([]string{"-o", "patch", "-f", "../examples/kotsadm-postgres-sts.yaml"}, nil, &out)
+		assert.NoError(t, err)
+		assert.Empty(t, out.String())
+	})
+
+	t.Run("unknown output", func(t *testing.T) {
+		err := runMutateCommand([]string{"-o", "json"}, nil, &bytes.Buffer{})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// namespaceAnnotationUIDKey, namespaceAnnotationGIDKey and
+	// namespaceAnnotationModeKey give the containers of the namespace that
+	// declare no owner a default owner and mode change
+	namespaceAnnotationUIDKey  = "volume-permissions-container-injector-webhook.malston.me/default-uid"
+	namespaceAnnotationGIDKey  = "volume-permissions-container-injector-webhook.malston.me/default-gid"
+	namespaceAnnotationModeKey = "volume-permissions-container-injector-webhook.malston.me/default-mode"
+	// namespaceAnnotationTemplateKey replaces the init container template
+	// for the pods of the namespace by one of the namespace templates of the
+	// configuration, named by its value
+	namespaceAnnotationTemplateKey = "volume-permissions-container-injector-webhook.malston.me/default-template"
+
+	// openshiftUIDRangeKey and openshiftSupplementalGroupsKey are the ranges
+	// OpenShift allocates to a namespace, as start/size or start-end. The
+	// restricted SCC runs pods declaring no user as the first uid of the
+	// range with the first group of the supplemental groups as fsGroup.
+	openshiftUIDRangeKey           = "openshift.io/sa.scc.uid-range"
+	openshiftSupplementalGroupsKey = "openshift.io/sa.scc.supplemental-groups"
+
+	// namespacePreset names the preset derived from the namespace in the
+	// ownership-presets annotation
+	namespacePreset = "namespace"
+)
+
+// namespaceDefaults are the settings a namespace gives its pods
+type namespaceDefaults struct {
+	// preset matches every image, it is nil when the namespace implies no
+	// owner
+	preset   *OwnershipPreset
+	template string
+	// podSecurity is the Pod Security level the namespace enforces, empty
+	// when it has no enforce label
+	podSecurity string
+}
+
+func (d *namespaceDefaults) podSecurityLevel() string {
+	if d == nil {
+		return ""
+	}
+	return d.podSecurity
+}
+
+// parseRangeStart returns the first id of an OpenShift range
+func parseRangeStart(r string) (int64, error) {
+	r = strings.TrimSpace(r)
+	// several ranges are comma separated, the first one is allocated first
+	if i := strings.Index(r, ","); i >= 0 {
+		r = r[:i]
+	}
+	if i := strings.IndexAny(r, "/-"); i >= 0 {
+		r = r[:i]
+	}
+	start, err := strconv.ParseInt(r, 10, 64)
+	if err != nil || start < 0 {
+		return 0, fmt.Errorf("invalid range %q", r)
+	}
+	return start, nil
+}
+
+// namespaceDefaultsFor reads the defaults from the namespace annotations. The
+// webhook annotations win over the OpenShift ranges; the group falls back to
+// the first supplemental group and then to the user, like the user falls
+// back to the group. The template is looked up by name in the configuration.
+func namespaceDefaultsFor(ns *corev1.Namespace, cfg *MutationConfig) (*namespaceDefaults, error) {
+	annotations := ns.Annotations
+	defaults := &namespaceDefaults{podSecurity: ns.Labels[podSecurityEnforceLabel]}
+	if name, ok := annotations[namespaceAnnotationTemplateKey]; ok {
+		template, ok := cfg.namespaceTemplates()[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid %s annotation of namespace %s: the configuration has no namespace template %q", namespaceAnnotationTemplateKey, ns.Name, name)
+		}
+		defaults.template = template
+	}
+
+	var uid, gid *int64
+	for _, id := range []struct {
+		key   string
+		value **int64
+		parse func(string) (int64, error)
+	}{
+		{openshiftUIDRangeKey, &uid, parseRangeStart},
+		{openshiftSupplementalGroupsKey, &gid, parseRangeStart},
+		{namespaceAnnotationUIDKey, &uid, parseID},
+		{namespaceAnnotationGIDKey, &gid, parseID},
+	} {
+		v, ok := annotations[id.key]
+		if !ok {
+			continue
+		}
+		parsed, err := id.parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation of namespace %s: %v", id.key, ns.Name, err)
+		}
+		*id.value = &parsed
+	}
+	mode := annotations[namespaceAnnotationModeKey]
+	if _, err := parseModeSpec(mode); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation of namespace %s: %v", namespaceAnnotationModeKey, ns.Name, err)
+	}
+	if uid != nil && gid == nil {
+		gid = uid
+	}
+	if gid != nil && uid == nil {
+		uid = gid
+	}
+	if uid != nil {
+		defaults.preset = &OwnershipPreset{Name: namespacePreset, Images: []string{"*"}, UID: *uid, GID: *gid, Mode: mode}
+	}
+	return defaults, nil
+}
+
+func (cfg *MutationConfig) namespaceTemplates() map[string]string {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.NamespaceTemplates
+}
+
+func parseID(v string) (int64, error) {
+	id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("expect a non-negative id, got %q", v)
+	}
+	return id, nil
+}
+
+// namespaceDefaults looks up the namespace of the pod template in the
+// informer cache, nil when it cannot be looked up
+func (m *mutator) namespaceDefaults(tmpl *podTemplate) (*namespaceDefaults, error) {
+	if m.namespaces == nil || tmpl.meta.Namespace == "" {
+		return nil, nil
+	}
+	ns, err := m.namespaces.Get(tmpl.meta.Namespace)
+	if err != nil {
+		glog.Warningf("Could not look up namespace %s, ignoring its defaults: %v", tmpl.meta.Namespace, err)
+		return nil, nil
+	}
+	return namespaceDefaultsFor(ns, m.config)
+}
+
+// withNamespaceDefaults returns the configuration the namespace defaults
+// apply to: the namespace owner comes before the presets and the namespace
+// template replaces the configured one
+func (cfg *MutationConfig) withNamespaceDefaults(defaults *namespaceDefaults) *MutationConfig {
+	if defaults == nil || (defaults.preset == nil && defaults.template == "") {
+		return cfg
+	}
+	merged := MutationConfig{}
+	if cfg != nil {
+		merged = *cfg
+	}
+	if defaults.preset != nil {
+		merged.OwnershipPresets = append([]OwnershipPreset{*defaults.preset}, cfg.ownershipPresets()...)
+	}
+	if defaults.template != "" {
+		merged.Template = defaults.template
+	}
+	return &merged
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseRangeStart(t *testing.T) {
+	for r, want := range map[string]int64{
+		"1000620000/10000":              1000620000,
+		"1000620000-1000629999":         1000620000,
+		"1000620000/10000,2000000000/5": 1000620000,
+	} {
+		start, err := parseRangeStart(r)
+		assert.NoError(t, err, r)
+		assert.Equal(t, want, start, r)
+	}
+	_, err := parseRangeStart("/10000")
+	assert.Error(t, err)
+}
+
+func TestNamespaceDefaultsFor(t *testing.T) {
+	ns := func(annotations map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps", Annotations: annotations}}
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        *OwnershipPreset
+		wantErr     bool
+	}{
+		{name: "none"},
+		{
+			name: "openshift ranges",
+			annotations: map[string]string{
+				openshiftUIDRangeKey:           "1000620000/10000",
+				openshiftSupplementalGroupsKey: "1000630000/10000",
+			},
+			want: &OwnershipPreset{Name: namespacePreset, Images: []string{"*"}, UID: 1000620000, GID: 1000630000},
+		},
+		{
+			name:        "openshift uid range alone",
+			annotations: map[string]string{openshiftUIDRangeKey: "1000620000/10000"},
+			want:        &OwnershipPreset{Name: namespacePreset, Images: []string{"*"}, UID: 1000620000, GID: 1000620000},
+		},
+		{
+			name: "webhook annotations win",
+			annotations: map[string]string{
+				openshiftUIDRangeKey:           "1000620000/10000",
+				openshiftSupplementalGroupsKey: "1000620000/10000",
+				namespaceAnnotationUIDKey:      "1000620001",
+				namespaceAnnotationModeKey:     "g+rwX",
+			},
+			want: &OwnershipPreset{Name: namespacePreset, Images: []string{"*"}, UID: 1000620001, GID: 1000620000, Mode: "g+rwX"},
+		},
+		{
+			name:        "group alone",
+			annotations: map[string]string{namespaceAnnotationGIDKey: "2000"},
+			want:        &OwnershipPreset{Name: namespacePreset, Images: []string{"*"}, UID: 2000, GID: 2000},
+		},
+		{name: "invalid uid", annotations: map[string]string{namespaceAnnotationUIDKey: "app"}, wantErr: true},
+		{name: "invalid mode", annotations: map[string]string{namespaceAnnotationUIDKey: "1000", namespaceAnnotationModeKey: "g+s"}, wantErr: true},
+		{name: "invalid range", annotations: map[string]string{openshiftUIDRangeKey: "all"}, wantErr: true},
+		{name: "unknown template", annotations: map[string]string{namespaceAnnotationTemplateKey: "mine"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaults, err := namespaceDefaultsFor(ns(tt.annotations), &MutationConfig{NamespaceTemplates: map[string]string{"shell": "initContainers: []"}})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, defaults.preset)
+		})
+	}
+
+	defaults, err := namespaceDefaultsFor(ns(map[string]string{namespaceAnnotationTemplateKey: "shell"}), &MutationConfig{NamespaceTemplates: map[string]string{"shell": "initContainers: []"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "initContainers: []", defaults.template)
+	_, err = namespaceDefaultsFor(ns(map[string]string{namespaceAnnotationTemplateKey: "shell"}), nil)
+	assert.Error(t, err, "namespaces bring no template of their own")
+}
+
+func TestEvaluateNamespaceDefaults(t *testing.T) {
+	tmpl := func(psc *corev1.PodSecurityContext) *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+			spec: &corev1.PodSpec{
+				SecurityContext: psc,
+				Containers: []corev1.Container{{
+					Name:         "app",
+					Image:        "docker.io/bitnami/redis:6",
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				}},
+				Volumes: []corev1.Volume{
+					{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				},
+			},
+		}
+	}
+	m := &mutator{namespaces: namespaceLister(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name: "apps",
+		Annotations: map[string]string{
+			openshiftUIDRangeKey:           "1000620000/10000",
+			openshiftSupplementalGroupsKey: "1000620000/10000",
+			namespaceAnnotationTemplateKey: "tools",
+		},
+	}}), config: &MutationConfig{NamespaceTemplates: map[string]string{
+		"tools": "initContainers:\n- name: volume-permissions\n  image: registry.example.com/tools/shell:1\n  command: [sh, -c, 'replace-script']\n  volumeMounts:\n  - mountPath: /replace-mountPath\n    name: replace-mountName\n",
+	}}}
+
+	d, err := m.evaluate(context.TODO(), tmpl(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1000620000:1000620000 /data"}, targetStrings(d.targets), "the namespace comes before the presets")
+	assert.Equal(t, "app="+namespacePreset, d.annotations[admissionWebhookAnnotationPresetsKey])
+	assert.Equal(t, "registry.example.com/tools/shell:1", d.initContainers[0].Image)
+
+	d, err = m.evaluate(context.TODO(), tmpl(&corev1.PodSecurityContext{FSGroup: int64Ptr(1000620005)}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1000620005:1000620005 /data"}, targetStrings(d.targets), "declared owners win")
+
+	d, err = (&mutator{namespaces: namespaceLister()}).evaluate(context.TODO(), tmpl(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1001:1001 /data"}, targetStrings(d.targets), "missing namespaces are ignored")
+}
+
+// namespaceLister serves the namespaces as the informer cache does
+func namespaceLister(namespaces ...*corev1.Namespace) corelisters.NamespaceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range namespaces {
+		_ = indexer.Add(ns)
+	}
+	return corelisters.NewNamespaceLister(indexer)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// nonRootPolicyOverride lets the injected containers run as root
+	// anyway, nonRootPolicyVerify switches the pod to the verify strategy
+	// running as the owner and nonRootPolicyDeny rejects the pod
+	nonRootPolicyOverride = "override"
+	nonRootPolicyVerify   = "verify"
+	nonRootPolicyDeny     = "deny"
+)
+
+func validNonRootPolicy(policy string) error {
+	switch policy {
+	case nonRootPolicyOverride, nonRootPolicyVerify, nonRootPolicyDeny:
+		return nil
+	}
+	return fmt.Errorf("unsupported non-root policy %q, expect %s, %s or %s", policy, nonRootPolicyOverride, nonRootPolicyVerify, nonRootPolicyDeny)
+}
+
+func (cfg *MutationConfig) nonRootPolicy() string {
+	if cfg == nil || cfg.NonRootPolicy == "" {
+		return nonRootPolicyOverride
+	}
+	return cfg.NonRootPolicy
+}
+
+// requiresNonRoot reports whether the pod makes its containers run as non-root
+// users, the injected containers inherit it and the kubelet refuses to start
+// them as root
+func requiresNonRoot(podSecurityContext *corev1.PodSecurityContext) bool {
+	return podSecurityContext != nil && podSecurityContext.RunAsNonRoot != nil && *podSecurityContext.RunAsNonRoot
+}
+
+// nonRootStrategy returns the strategy of a pod requiring non-root
+// containers under the non-root policy, or why the pod is denied. Pods
+// verifying their volumes run the injected containers as the owner already.
+func (cfg *MutationConfig) nonRootStrategy(strategy string, targets []*chownTarget) (string, error) {
+	if strategy == strategyVerify {
+		return strategy, nil
+	}
+	switch cfg.nonRootPolicy() {
+	case nonRootPolicyVerify:
+		for _, t := range targets {
+			if t.uid == 0 {
+				return "", fmt.Errorf("the pod requires non-root containers (runAsNonRoot) and volume %s is owned by root, the %s strategy cannot run as its owner", t.mountName, strategyVerify)
+			}
+		}
+		return strategyVerify, nil
+	case nonRootPolicyDeny:
+		return "", fmt.Errorf("the pod requires non-root containers (runAsNonRoot) and the non-root policy denies the root %s init container; set securityContext.runAsNonRoot on the app containers instead of the pod, or use the %s strategy", initContainerName, strategyVerify)
+	}
+	return strategy, nil
+}
+
+// overrideNonRoot lets the injected containers that may run as root start in
+// a pod requiring non-root containers
+func overrideNonRoot(containers []corev1.Container) {
+	for i := range containers {
+		c := &containers[i]
+		if c.SecurityContext == nil {
+			c.SecurityContext = &corev1.SecurityContext{}
+		}
+		sc := c.SecurityContext
+		if sc.RunAsNonRoot != nil || (sc.RunAsUser != nil && *sc.RunAsUser != 0) {
+			continue
+		}
+		runAsNonRoot := false
+		sc.RunAsNonRoot = &runAsNonRoot
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEvaluateNonRootPods(t *testing.T) {
+	runAsNonRoot := true
+	tmpl := func(fsGroup int64) *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+			spec: &corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{RunAsNonRoot: &runAsNonRoot, FSGroup: &fsGroup},
+				Containers: []corev1.Container{{
+					Name:         "app",
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				}},
+				Volumes: []corev1.Volume{
+					{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				},
+			},
+		}
+	}
+
+	t.Run("override", func(t *testing.T) {
+		d, err := (&mutator{}).evaluate(context.TODO(), tmpl(1001))
+		assert.NoError(t, err)
+		sc := d.initContainers[0].SecurityContext
+		assert.Equal(t, int64(0), *sc.RunAsUser)
+		assert.False(t, *sc.RunAsNonRoot)
+		assert.Contains(t, d.warnings[len(d.warnings)-1], "overrides it to run as root")
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		m := &mutator{config: &MutationConfig{NonRootPolicy: nonRootPolicyVerify}}
+		d, err := m.evaluate(context.TODO(), tmpl(1001))
+		assert.NoError(t, err)
+		c := d.initContainers[0]
+		assert.Equal(t, int64(1001), *c.SecurityContext.RunAsUser)
+		assert.Nil(t, c.SecurityContext.RunAsNonRoot)
+		assert.Contains(t, c.Command[2], "! -writable")
+		assert.Contains(t, d.warnings, "the pod requires non-root containers (runAsNonRoot), its volumes are verified instead of fixed")
+
+		d, err = m.evaluate(context.TODO(), tmpl(0))
+		assert.NoError(t, err)
+		assert.True(t, d.deny, "root owners cannot be verified as non-root")
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		m := &mutator{config: &MutationConfig{NonRootPolicy: nonRootPolicyDeny}}
+		d, err := m.evaluate(context.TODO(), tmpl(1001))
+		assert.NoError(t, err)
+		assert.True(t, d.deny)
+		assert.Contains(t, d.reason, "runAsNonRoot")
+
+		pod := tmpl(1001)
+		pod.meta.Annotations = map[string]string{admissionWebhookAnnotationStrategyKey: strategyVerify}
+		d, err = m.evaluate(context.TODO(), pod)
+		assert.NoError(t, err)
+		assert.True(t, d.inject, "verifying pods run as the owner already")
+	})
+}
+
+func TestOverrideNonRoot(t *testing.T) {
+	explicit := true
+	containers := []corev1.Container{
+		{Name: "root", SecurityContext: &corev1.SecurityContext{RunAsUser: int64Ptr(0)}},
+		{Name: "image user"},
+		{Name: "owner", SecurityContext: &corev1.SecurityContext{RunAsUser: int64Ptr(1001)}},
+		{Name: "template", SecurityContext: &corev1.SecurityContext{RunAsNonRoot: &explicit}},
+	}
+	overrideNonRoot(containers)
+	assert.False(t, *containers[0].SecurityContext.RunAsNonRoot)
+	assert.False(t, *containers[1].SecurityContext.RunAsNonRoot)
+	assert.Nil(t, containers[2].SecurityContext.RunAsNonRoot)
+	assert.True(t, *containers[3].SecurityContext.RunAsNonRoot)
+}
+
+func TestParseNonRootPolicy(t *testing.T) {
+	_, err := parseMutationConfig([]byte("nonRootPolicy: skip\n"))
+	assert.Error(t, err)
+	cfg, err := parseMutationConfig([]byte("nonRootPolicy: verify\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, nonRootPolicyVerify, cfg.nonRootPolicy())
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	conflictPolicyFirstWins     = "first-wins"
+	conflictPolicyFail          = "fail"
+	conflictPolicyGroupWritable = "group-writable"
+)
+
+// mountOwner is the owner a container expects on one of its volume mounts
+type mountOwner struct {
+	container string
+	mount     corev1.VolumeMount
+	env       []corev1.EnvVar
+	uid       int64
+	gid       int64
+	// mode and preset come from the ownership preset of the container image
+	// when the pod declares no owner
+	mode   string
+	preset string
+}
+
+// chownTarget is a portion of a volume the injected init container chowns and
+// the owner it is chowned to
+type chownTarget struct {
+	uid         int64
+	gid         int64
+	mountPath   string
+	mountName   string
+	subPath     string
+	subPathExpr string
+	// groupWritable makes the portion writable by the group on top of the
+	// chown, used when containers disagree on the owner
+	groupWritable bool
+	// mode is a mode change of the portion, from an ownership preset
+	mode string
+	// env holds the app container variables referenced by subPathExpr
+	env []corev1.EnvVar
+	// lease names the lease coordinating the fix with the other pods
+	// sharing the claim, it is empty when the fix is not coordinated
+	lease string
+	// claim names the claim the fix is recorded on, it is empty when the fix
+	// is not recorded
+	claim string
+}
+
+// groupWritableMode is the mode change making a portion group writable
+const groupWritableMode = "g+rwX"
+
+// modeChange returns the mode change of the portion, empty for none
+func (t *chownTarget) modeChange() string {
+	if t.groupWritable {
+		return groupWritableMode
+	}
+	return t.mode
+}
+
+func (t *chownTarget) String() string {
+	target := fmt.Sprintf("%d:%d %s", t.uid, t.gid, t.mountPath)
+	if t.subPath != "" {
+		target += " subPath=" + t.subPath
+	}
+	if t.subPathExpr != "" {
+		target += " subPathExpr=" + t.subPathExpr
+	}
+	if t.groupWritable {
+		target += " group-writable"
+	}
+	return target
+}
+
+// findMountOwners returns the owner each container expects on its eligible
+// volume mounts. The group is the container's RunAsGroup, falling back to the
+// pod's FSGroup and RunAsGroup, containers without a group are skipped. The
+// user is the container's RunAsUser, falling back to the pod's RunAsUser and
+// then to the group. Containers declaring neither get the owner of the first
+// preset matching their image. Read-only mounts are skipped.
+func findMountOwners(podSecurityContext *corev1.PodSecurityContext, containers []corev1.Container, eligible func(name string) bool, presets []OwnershipPreset) []mountOwner {
+	var owners []mountOwner
+	var podUID, podGID, fsGroup *int64
+	if podSecurityContext != nil {
+		podUID, podGID, fsGroup = podSecurityContext.RunAsUser, podSecurityContext.RunAsGroup, podSecurityContext.FSGroup
+	}
+	for _, c := range containers {
+		var containerUID, containerGID *int64
+		if c.SecurityContext != nil {
+			containerUID, containerGID = c.SecurityContext.RunAsUser, c.SecurityContext.RunAsGroup
+		}
+		gid := firstInt64(containerGID, fsGroup, podGID)
+		uid := firstInt64(containerUID, podUID, gid)
+		var preset *OwnershipPreset
+		if uid == nil {
+			if preset = presetFor(presets, c.Image); preset != nil {
+				uid, gid = &preset.UID, &preset.GID
+			}
+		}
+		if gid == nil {
+			continue
+		}
+
+		for _, v := range c.VolumeMounts {
+			if v.ReadOnly || !eligible(v.Name) {
+				continue
+			}
+			owner := mountOwner{
+				container: c.Name,
+				mount:     v,
+				env:       referencedEnv(c.Env, v.SubPathExpr),
+				uid:       *uid,
+				gid:       *gid,
+			}
+			if preset != nil {
+				owner.mode, owner.preset = preset.Mode, preset.Name
+			}
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+func firstInt64(values ...*int64) *int64 {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// ownershipConflictError is returned when containers disagree on the owner
+// of a volume and the conflict policy is fail
+type ownershipConflictError struct {
+	conflicts []string
+}
+
+func (e *ownershipConflictError) Error() string {
+	return "conflicting volume ownership: " + strings.Join(e.conflicts, "; ")
+}
+
+// resolveOwnership turns the mount owners into chown targets, one per portion
+// of a volume, in the order the portions are first mounted. When containers
+// disagree on the owner of a portion the conflict policy decides: first-wins
+// keeps the owner of the first container, group-writable keeps its user but
+// chowns to the shared group and makes the portion group writable, and fail
+// returns an ownershipConflictError. The conflicts are described in the
+// returned report.
+func resolveOwnership(owners []mountOwner, policy string, sharedGroup *int64) ([]*chownTarget, []string, error) {
+	var targets []*chownTarget
+	var report []string
+	seen := map[string][]mountOwner{}
+	var order []string
+	for _, o := range owners {
+		key := o.mount.Name + "\x00" + o.mount.SubPath + "\x00" + o.mount.SubPathExpr
+		if _, ok := seen[key]; !ok {
+			order = append(order, key)
+		}
+		seen[key] = append(seen[key], o)
+	}
+
+	for _, key := range order {
+		group := seen[key]
+		first := group[0]
+		target := &chownTarget{
+			uid:         first.uid,
+			gid:         first.gid,
+			mountPath:   first.mount.MountPath,
+			mountName:   first.mount.Name,
+			subPath:     first.mount.SubPath,
+			subPathExpr: first.mount.SubPathExpr,
+			mode:        first.mode,
+			env:         first.env,
+		}
+		targets = append(targets, target)
+
+		var owners []string
+		conflict := false
+		for _, o := range group {
+			owners = append(owners, fmt.Sprintf("%s %d:%d", o.container, o.uid, o.gid))
+			if o.uid != first.uid || o.gid != first.gid {
+				conflict = true
+			}
+		}
+		if !conflict {
+			continue
+		}
+
+		conflictDescription := fmt.Sprintf("volume %s is mounted by %s", first.mount.Name, strings.Join(owners, ", "))
+		switch policy {
+		case conflictPolicyFail:
+			report = append(report, conflictDescription)
+			continue
+		case conflictPolicyGroupWritable:
+			if sharedGroup == nil {
+				return nil, nil, fmt.Errorf("%s, the %s conflict policy needs a pod fsGroup or a sharedGroup", conflictDescription, conflictPolicyGroupWritable)
+			}
+			target.gid = *sharedGroup
+			target.groupWritable = true
+		}
+		report = append(report, fmt.Sprintf("%s, resolved by %s to %d:%d", conflictDescription, policy, target.uid, target.gid))
+	}
+
+	if policy == conflictPolicyFail && len(report) > 0 {
+		return nil, nil, &ownershipConflictError{conflicts: report}
+	}
+	assignMountPaths(targets)
+	return targets, report, nil
+}
+
+// assignMountPaths moves targets whose mount path is already taken by another
+// portion to a path of their own, the injected container mounts all of them
+func assignMountPaths(targets []*chownTarget) {
+	used := map[string]bool{}
+	for _, t := range targets {
+		if used[t.mountPath] {
+			base := path.Join("/volume-permissions", t.mountName)
+			t.mountPath = base
+			for i := 1; used[t.mountPath]; i++ {
+				t.mountPath = fmt.Sprintf("%s-%d", base, i)
+			}
+		}
+		used[t.mountPath] = true
+	}
+}
+
+var envReference = regexp.MustCompile(`\$\(([A-Za-z_][A-Za-z0-9_]*)\)`)
+
+// referencedEnv returns the variables referenced as $(NAME) by the expression
+func referencedEnv(env []corev1.EnvVar, expr string) []corev1.EnvVar {
+	var referenced []corev1.EnvVar
+	for _, m := range envReference.FindAllStringSubmatch(expr, -1) {
+		for _, e := range env {
+			if e.Name == m[1] {
+				referenced = append(referenced, e)
+				break
+			}
+		}
+	}
+	return referenced
+}
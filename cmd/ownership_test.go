@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func int64Ptr(i int64) *int64 { return &i }
+
+// exporterPod runs an app as 1001 and a metrics exporter as 65534, the
+// exporter mounts the given volume
+func exporterPod(exporterVolume string, fsGroup *int64) *podTemplate {
+	return &podTemplate{
+		meta: &metav1.ObjectMeta{Name: "app", Namespace: "sentry-pro"},
+		spec: &corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:            "app",
+					SecurityContext: &corev1.SecurityContext{RunAsUser: int64Ptr(1001), RunAsGroup: int64Ptr(1001)},
+					VolumeMounts:    []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				},
+				{
+					Name:            "exporter",
+					SecurityContext: &corev1.SecurityContext{RunAsUser: int64Ptr(65534), RunAsGroup: int64Ptr(65534)},
+					VolumeMounts:    []corev1.VolumeMount{{Name: exporterVolume, MountPath: "/data"}},
+				},
+			},
+			SecurityContext: &corev1.PodSecurityContext{FSGroup: fsGroup},
+			Volumes: []corev1.Volume{
+				{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				{Name: "metrics", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "metrics"}}},
+			},
+		},
+	}
+}
+
+func TestEvaluateOwnership(t *testing.T) {
+	t.Run("containers owning different volumes", func(t *testing.T) {
+		d, err := (&mutator{}).evaluate(context.TODO(), exporterPod("metrics", nil))
+		assert.NoError(t, err)
+		assert.True(t, d.inject)
+		assert.Equal(t, []string{"1001:1001 /data", "65534:65534 /volume-permissions/metrics"}, targetStrings(d.targets))
+		assert.Equal(t, []string{"/bin/bash", "-ec", "chown -R 1001:1001 /data\nchown -R 65534:65534 /volume-permissions/metrics"}, d.initContainers[0].Command)
+		assert.Equal(t, []corev1.VolumeMount{
+			{Name: "data", MountPath: "/data"},
+			{Name: "metrics", MountPath: "/volume-permissions/metrics"},
+		}, d.initContainers[0].VolumeMounts)
+		assert.Empty(t, d.warnings)
+		assert.NotContains(t, d.annotations, admissionWebhookAnnotationConflictsKey)
+	})
+
+	t.Run("first-wins", func(t *testing.T) {
+		d, err := (&mutator{}).evaluate(context.TODO(), exporterPod("data", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1001:1001 /data"}, targetStrings(d.targets))
+		assert.Equal(t, "volume data is mounted by app 1001:1001, exporter 65534:65534, resolved by first-wins to 1001:1001", d.annotations[admissionWebhookAnnotationConflictsKey])
+		assert.Len(t, d.warnings, 1)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		m := &mutator{config: &MutationConfig{ConflictPolicy: conflictPolicyFail}}
+		d, err := m.evaluate(context.TODO(), exporterPod("data", nil))
+		assert.NoError(t, err)
+		assert.True(t, d.deny)
+		assert.Equal(t, "conflicting volume ownership: volume data is mounted by app 1001:1001, exporter 65534:65534", d.reason)
+
+		d, err = m.evaluate(context.TODO(), exporterPod("metrics", nil))
+		assert.NoError(t, err)
+		assert.True(t, d.inject)
+	})
+
+	t.Run("group-writable with fsGroup", func(t *testing.T) {
+		m := &mutator{config: &MutationConfig{ConflictPolicy: conflictPolicyGroupWritable}}
+		d, err := m.evaluate(context.TODO(), exporterPod("data", int64Ptr(2000)))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1001:2000 /data group-writable"}, targetStrings(d.targets))
+		assert.Equal(t, []string{"/bin/bash", "-ec", "chown -R 1001:2000 /data\nchmod -R g+rwX /data"}, d.initContainers[0].Command)
+		assert.Empty(t, d.supplementalGroups)
+	})
+
+	t.Run("group-writable with shared group", func(t *testing.T) {
+		m := &mutator{config: &MutationConfig{ConflictPolicy: conflictPolicyGroupWritable, SharedGroup: int64Ptr(3000)}}
+		tmpl := exporterPod("data", nil)
+		// the first container inherits the fsGroup as group when it has none
+		tmpl.spec.Containers[0].SecurityContext.RunAsGroup = nil
+		tmpl.spec.SecurityContext.FSGroup = int64Ptr(1001)
+		d, err := m.evaluate(context.TODO(), tmpl)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1001:3000 /data group-writable"}, targetStrings(d.targets))
+		assert.Equal(t, []int64{3000}, d.supplementalGroups)
+
+		patch, err := createPatch(tmpl, d)
+		assert.NoError(t, err)
+		assert.Contains(t, string(patch), `{"op":"add","path":"/spec/securityContext/supplementalGroups","value":[3000]}`)
+	})
+
+	t.Run("group-writable without a group", func(t *testing.T) {
+		m := &mutator{config: &MutationConfig{ConflictPolicy: conflictPolicyGroupWritable}}
+		d, err := m.evaluate(context.TODO(), exporterPod("data", nil))
+		assert.NoError(t, err)
+		assert.True(t, d.deny)
+	})
+}
+
+func targetStrings(targets []*chownTarget) []string {
+	var s []string
+	for _, t := range targets {
+		s = append(s, t.String())
+	}
+	return s
+}
+
+func TestEvaluateIgnoredContainers(t *testing.T) {
+	pod := func() *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "app", Namespace: "sentry-pro"},
+			spec: &corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:            "istio-proxy",
+						Image:           "docker.io/istio/proxyv2:1.10.0",
+						SecurityContext: &corev1.SecurityContext{RunAsUser: int64Ptr(1337), RunAsGroup: int64Ptr(1337)},
+						VolumeMounts:    []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+					},
+					{
+						Name:            "logs",
+						Image:           "fluent/fluent-bit:1.8",
+						SecurityContext: &corev1.SecurityContext{RunAsUser: int64Ptr(0), RunAsGroup: int64Ptr(0)},
+						VolumeMounts:    []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+					},
+					{
+						Name:         "app",
+						Image:        "docker.io/bitnami/redis:6.2",
+						VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+					},
+				},
+				SecurityContext: &corev1.PodSecurityContext{FSGroup: int64Ptr(1001)},
+				Volumes: []corev1.Volume{
+					{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				},
+			},
+		}
+	}
+
+	t.Run("default sidecars", func(t *testing.T) {
+		d, err := (&mutator{}).evaluate(context.TODO(), pod())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1001:1001 /data"}, targetStrings(d.targets))
+		assert.Empty(t, d.warnings)
+	})
+
+	t.Run("configured sidecars replace the defaults", func(t *testing.T) {
+		m := &mutator{config: &MutationConfig{IgnoredContainers: &ContainerSelector{Names: []string{"logs"}}}}
+		d, err := m.evaluate(context.TODO(), pod())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1337:1337 /data"}, targetStrings(d.targets))
+	})
+
+	t.Run("only sidecars", func(t *testing.T) {
+		tmpl := pod()
+		tmpl.spec.Containers = tmpl.spec.Containers[:2]
+		d, err := (&mutator{}).evaluate(context.TODO(), tmpl)
+		assert.NoError(t, err)
+		assert.False(t, d.inject)
+	})
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"istio-proxy", "istio-proxy", true},
+		{"istio-proxy", "istio-proxy-2", false},
+		{"*istio/proxyv2*", "docker.io/istio/proxyv2:1.10.0", true},
+		{"*istio/proxyv2*", "docker.io/istio/pilot:1.10.0", false},
+		{"*linkerd*/proxy:*", "cr.l5d.io/linkerd/proxy:stable-2.10.2", true},
+		{"docker.io/*:latest", "docker.io/bitnami/redis:latest", true},
+		{"docker.io/*:latest", "docker.io/bitnami/redis:6.2", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchPattern(tt.pattern, tt.s), "matchPattern(%q, %q)", tt.pattern, tt.s)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// admissionWebhookAnnotationIncludePathsKey and
+	// admissionWebhookAnnotationExcludePathsKey hold comma separated path
+	// patterns overriding the configured ones for a pod
+	admissionWebhookAnnotationIncludePathsKey = "volume-permissions-container-injector-webhook.malston.me/include-paths"
+	admissionWebhookAnnotationExcludePathsKey = "volume-permissions-container-injector-webhook.malston.me/exclude-paths"
+	admissionWebhookAnnotationMaxDepthKey     = "volume-permissions-container-injector-webhook.malston.me/max-depth"
+	// admissionWebhookAnnotationStopAtMountPointsKey is true or false
+	admissionWebhookAnnotationStopAtMountPointsKey = "volume-permissions-container-injector-webhook.malston.me/stop-at-mount-points"
+)
+
+// PathOptions narrows down the entries of a volume whose ownership is fixed.
+// Patterns are relative to the volume root, ** and * match any run of
+// characters. A pattern without a slash matches entries of that name at any
+// depth.
+type PathOptions struct {
+	// Include restricts the fix to the volume root and the matching entries
+	// together with everything below them
+	Include []string `json:"include,omitempty"`
+	// Exclude skips the matching entries and everything below them, for
+	// example lost+found or the read-only .snapshot directories of NetApp
+	// volumes
+	Exclude []string `json:"exclude,omitempty"`
+	// MaxDepth limits how deep the walk descends, 0 fixes the volume root only
+	MaxDepth *int `json:"maxDepth,omitempty"`
+	// StopAtMountPoints keeps the walk on the file system of the volume
+	StopAtMountPoints bool `json:"stopAtMountPoints,omitempty"`
+}
+
+func (o *PathOptions) empty() bool {
+	return o == nil || len(o.Include) == 0 && len(o.Exclude) == 0 && o.MaxDepth == nil && !o.StopAtMountPoints
+}
+
+// record describes the entries the options select, as recorded with a fix
+// so a fix selecting other entries is not taken for it
+func (o *PathOptions) record() string {
+	paths, maxDepth := PathOptions{}, -1
+	if o != nil {
+		paths = *o
+	}
+	if paths.MaxDepth != nil {
+		maxDepth = *paths.MaxDepth
+	}
+	return fmt.Sprintf("include=%s exclude=%s max-depth=%d xdev=%t",
+		strings.Join(paths.Include, ","), strings.Join(paths.Exclude, ","), maxDepth, paths.StopAtMountPoints)
+}
+
+func (o *PathOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.MaxDepth != nil && *o.MaxDepth < 0 {
+		return fmt.Errorf("maxDepth must not be negative, got %d", *o.MaxDepth)
+	}
+	for _, p := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if strings.Trim(p, "/") == "" {
+			return fmt.Errorf("empty path pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// pathOptionsFor returns the configured path options with the pod annotations
+// applied on top of them
+func pathOptionsFor(cfg *MutationConfig, annotations map[string]string) (*PathOptions, error) {
+	var opts PathOptions
+	if cfg != nil && cfg.Paths != nil {
+		opts = *cfg.Paths
+	}
+	if v, ok := annotations[admissionWebhookAnnotationIncludePathsKey]; ok {
+		opts.Include = splitList(v)
+	}
+	if v, ok := annotations[admissionWebhookAnnotationExcludePathsKey]; ok {
+		opts.Exclude = splitList(v)
+	}
+	if v, ok := annotations[admissionWebhookAnnotationMaxDepthKey]; ok {
+		depth, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q: %v", admissionWebhookAnnotationMaxDepthKey, v, err)
+		}
+		opts.MaxDepth = &depth
+	}
+	if v, ok := annotations[admissionWebhookAnnotationStopAtMountPointsKey]; ok {
+		stop, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q: %v", admissionWebhookAnnotationStopAtMountPointsKey, v, err)
+		}
+		opts.StopAtMountPoints = stop
+	}
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid path options: %v", err)
+	}
+	return &opts, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// findCommand returns a find command running the action on the entries of
+// root selected by the path options, root is quoted for the shell
+func findCommand(root string, opts *PathOptions, action string) string {
+	cmd := []string{"find", shellWord(root)}
+	if opts.StopAtMountPoints {
+		cmd = append(cmd, "-xdev")
+	}
+	if opts.MaxDepth != nil {
+		cmd = append(cmd, "-maxdepth", strconv.Itoa(*opts.MaxDepth))
+	}
+	if len(opts.Exclude) > 0 {
+		var exclude []string
+		for _, p := range opts.Exclude {
+			exclude = append(exclude, pathTests(root, p, false)...)
+		}
+		cmd = append(cmd, anyOf(exclude), "-prune", "-o")
+	}
+	if len(opts.Include) > 0 {
+		include := []string{"-path " + shellQuote(root)}
+		for _, p := range opts.Include {
+			include = append(include, pathTests(root, p, true)...)
+		}
+		cmd = append(cmd, anyOf(include))
+	}
+	return strings.Join(append(cmd, action), " ")
+}
+
+// pathTests translates a pattern to find tests. Descendants extends the match
+// to everything below the matching entries.
+func pathTests(root, pattern string, descendants bool) []string {
+	pattern = strings.Replace(strings.Trim(pattern, "/"), "**", "*", -1)
+	// find prints the entries below a root of / as /name, not //name
+	root = strings.TrimSuffix(root, "/")
+	if strings.Contains(pattern, "/") {
+		tests := []string{"-path " + shellQuote(root+"/"+pattern)}
+		if descendants {
+			tests = append(tests, "-path "+shellQuote(root+"/"+pattern+"/*"))
+		}
+		return tests
+	}
+	tests := []string{"-name " + shellQuote(pattern)}
+	if descendants {
+		tests = append(tests, "-path "+shellQuote(root+"/"+pattern+"/*"), "-path "+shellQuote(root+"/*/"+pattern+"/*"))
+	}
+	return tests
+}
+
+// anyOf joins find tests with -o inside escaped parentheses
+func anyOf(tests []string) string {
+	return `\( ` + strings.Join(tests, " -o ") + ` \)`
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellWord quotes the string for the shell unless it is a plain word, like
+// most mount paths, which the shell leaves as is
+func shellWord(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_./:@%+=,-") == "" {
+		return s
+	}
+	return shellQuote(s)
+}
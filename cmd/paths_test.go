@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFindCommand(t *testing.T) {
+	depth := 2
+	tests := []struct {
+		name string
+		opts *PathOptions
+		want string
+	}{
+		{
+			name: "exclude",
+			opts: &PathOptions{Exclude: []string{".snapshot", "lost+found", "backups/**"}},
+			want: `find /data \( -name '.snapshot' -o -name 'lost+found' -o -path '/data/backups/*' \) -prune -o -print`,
+		},
+		{
+			name: "include",
+			opts: &PathOptions{Include: []string{"db", "/logs/app"}},
+			want: `find /data \( -path '/data' -o -name 'db' -o -path '/data/db/*' -o -path '/data/*/db/*' -o -path '/data/logs/app' -o -path '/data/logs/app/*' \) -print`,
+		},
+		{
+			name: "boundaries",
+			opts: &PathOptions{MaxDepth: &depth, StopAtMountPoints: true},
+			want: `find /data -xdev -maxdepth 2 -print`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, findCommand("/data", tt.opts, "-print"))
+		})
+	}
+	assert.Equal(t, `find / \( -path '/' -o -path '/srv/db' -o -path '/srv/db/*' \) -print`,
+		findCommand("/", &PathOptions{Include: []string{"srv/db"}}, "-print"), "a root of / is not doubled")
+}
+
+func TestShellWord(t *testing.T) {
+	assert.Equal(t, "/bitnami/redis/data", shellWord("/bitnami/redis/data"))
+	assert.Equal(t, `'/data/my files'`, shellWord("/data/my files"))
+	assert.Equal(t, `'/data/$(reboot)'`, shellWord("/data/$(reboot)"))
+	assert.Equal(t, `'/data/it'\''s'`, shellWord("/data/it's"))
+	assert.Equal(t, `find '/data;id' -print`, findCommand("/data;id", &PathOptions{}, "-print"))
+}
+
+func TestPathOptionsFor(t *testing.T) {
+	depth := 3
+	cfg := &MutationConfig{Paths: &PathOptions{Exclude: []string{"lost+found"}, MaxDepth: &depth}}
+
+	opts, err := pathOptionsFor(cfg, map[string]string{
+		admissionWebhookAnnotationExcludePathsKey:      ".snapshot, backups/**",
+		admissionWebhookAnnotationStopAtMountPointsKey: "true",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &PathOptions{Exclude: []string{".snapshot", "backups/**"}, MaxDepth: &depth, StopAtMountPoints: true}, opts)
+	assert.Equal(t, []string{"lost+found"}, cfg.Paths.Exclude, "the configuration is left untouched")
+
+	_, err = pathOptionsFor(cfg, map[string]string{admissionWebhookAnnotationMaxDepthKey: "-1"})
+	assert.Error(t, err)
+	_, err = pathOptionsFor(nil, map[string]string{admissionWebhookAnnotationStopAtMountPointsKey: "sometimes"})
+	assert.Error(t, err)
+}
+
+func TestEvaluatePathOptions(t *testing.T) {
+	pod := func(annotations map[string]string) *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "nfs-app", Namespace: "sentry-pro", Annotations: annotations},
+			spec: &corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name:         "app",
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				}},
+				SecurityContext: &corev1.PodSecurityContext{FSGroup: int64Ptr(1001)},
+				Volumes: []corev1.Volume{
+					{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				},
+			},
+		}
+	}
+	m := &mutator{config: &MutationConfig{Paths: &PathOptions{Exclude: []string{".snapshot"}}}}
+
+	d, err := m.evaluate(context.TODO(), pod(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/bash", "-ec", `find /data \( -name '.snapshot' \) -prune -o -exec chown -h 1001:1001 {} +`}, d.initContainers[0].Command)
+
+	d, err = m.evaluate(context.TODO(), pod(map[string]string{admissionWebhookAnnotationMaxDepthKey: "deep"}))
+	assert.NoError(t, err)
+	assert.True(t, d.deny)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// podSecurityEnforceLabel is the namespace label holding the Pod
+	// Security level the API server enforces
+	podSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+
+	podSecurityPrivileged = "privileged"
+	podSecurityBaseline   = "baseline"
+	podSecurityRestricted = "restricted"
+)
+
+// baselineCapabilities are the capabilities the baseline level lets
+// containers add
+var baselineCapabilities = []corev1.Capability{
+	"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD", "NET_BIND_SERVICE",
+	"SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT",
+}
+
+// baselineSELinuxTypes are the SELinux types the baseline level lets
+// containers run as
+var baselineSELinuxTypes = []string{"container_t", "container_init_t", "container_kvm_t"}
+
+// podSecurityStrategy adapts the fix to the Pod Security level of the
+// namespace. Baseline admits root containers with a restricted set of
+// capabilities but not the SELinux type relabeling needs, restricted admits
+// no root container so only verifying is left. The warnings tell what was
+// changed or that nothing compatible exists.
+func podSecurityStrategy(level, strategy string, targets []*chownTarget, relabel *selinuxRelabel) (string, *selinuxRelabel, []string) {
+	var warnings []string
+	switch level {
+	case podSecurityBaseline, podSecurityRestricted:
+		if relabel != nil && relabel.processType != "" && !containsString(baselineSELinuxTypes, relabel.processType) {
+			warnings = append(warnings, fmt.Sprintf("Pod Security %s rejects the SELinux type %s the relabel runs as, not relabeling", level, relabel.processType))
+			relabel = nil
+		}
+	}
+	if level != podSecurityRestricted || strategy == strategyVerify {
+		return strategy, relabel, warnings
+	}
+	for _, t := range targets {
+		if t.uid == 0 {
+			return strategy, relabel, append(warnings, fmt.Sprintf("Pod Security %s rejects the root %s init container and volume %s is owned by root so it cannot be verified either, no strategy is compatible", level, initContainerName, t.mountName))
+		}
+	}
+	return strategyVerify, nil, append(warnings, fmt.Sprintf("Pod Security %s rejects the root %s init container, the volumes are verified instead of fixed", level, initContainerName))
+}
+
+// hardeningFor returns the hardening of the level: baseline and restricted
+// need the capabilities restricted whatever the configuration
+func hardeningFor(level string, h Hardening) Hardening {
+	if level == podSecurityBaseline || level == podSecurityRestricted {
+		on := true
+		h.DropCapabilities = &on
+	}
+	if level == podSecurityRestricted {
+		on := true
+		h.NoPrivilegeEscalation, h.RuntimeDefaultSeccomp = &on, &on
+	}
+	return h
+}
+
+// applyRestricted declares the containers run as non-root users, as the
+// restricted level asks, when they do
+func applyRestricted(containers []corev1.Container) {
+	for i := range containers {
+		sc := containers[i].SecurityContext
+		if sc == nil || sc.RunAsNonRoot != nil || sc.RunAsUser == nil || *sc.RunAsUser == 0 {
+			continue
+		}
+		runAsNonRoot := true
+		sc.RunAsNonRoot = &runAsNonRoot
+	}
+}
+
+// podSecurityViolations lists the checks of the level the container fails,
+// in the pod with the security context
+func podSecurityViolations(level string, c *corev1.Container, podSecurityContext *corev1.PodSecurityContext) []string {
+	if level != podSecurityBaseline && level != podSecurityRestricted {
+		return nil
+	}
+	sc := c.SecurityContext
+	if sc == nil {
+		sc = &corev1.SecurityContext{}
+	}
+	psc := podSecurityContext
+	if psc == nil {
+		psc = &corev1.PodSecurityContext{}
+	}
+
+	var violations []string
+	if sc.Privileged != nil && *sc.Privileged {
+		violations = append(violations, "privileged")
+	}
+	allowed := baselineCapabilities
+	if level == podSecurityRestricted {
+		allowed = []corev1.Capability{"NET_BIND_SERVICE"}
+	}
+	if sc.Capabilities != nil {
+		for _, add := range sc.Capabilities.Add {
+			if !containsCapability(allowed, add) {
+				violations = append(violations, "adds capability "+string(add))
+			}
+		}
+	}
+	for _, options := range []*corev1.SELinuxOptions{sc.SELinuxOptions, psc.SELinuxOptions} {
+		if options != nil && options.Type != "" && !containsString(baselineSELinuxTypes, options.Type) {
+			violations = append(violations, "runs as SELinux type "+options.Type)
+		}
+	}
+	seccomp := sc.SeccompProfile
+	if seccomp == nil {
+		seccomp = psc.SeccompProfile
+	}
+	if seccomp != nil && seccomp.Type == corev1.SeccompProfileTypeUnconfined {
+		violations = append(violations, "unconfined seccomp profile")
+	}
+	if level == podSecurityBaseline {
+		return violations
+	}
+
+	if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		violations = append(violations, "allows privilege escalation")
+	}
+	if sc.Capabilities == nil || !containsCapability(sc.Capabilities.Drop, "ALL") {
+		violations = append(violations, "does not drop ALL capabilities")
+	}
+	if runAsNonRoot := firstBool(sc.RunAsNonRoot, psc.RunAsNonRoot); runAsNonRoot == nil || !*runAsNonRoot {
+		violations = append(violations, "does not set runAsNonRoot")
+	}
+	if runAsUser := firstInt64(sc.RunAsUser, psc.RunAsUser); runAsUser != nil && *runAsUser == 0 {
+		violations = append(violations, "runs as root")
+	}
+	if seccomp == nil {
+		violations = append(violations, "sets no seccomp profile")
+	}
+	return violations
+}
+
+func containsCapability(caps []corev1.Capability, c corev1.Capability) bool {
+	for _, v := range caps {
+		if strings.EqualFold(string(v), string(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstBool(values ...*bool) *bool {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// podSecurityWarnings warns about the injected containers the level of the
+// namespace rejects, so the rejection points to the webhook
+func podSecurityWarnings(level, namespace string, containers []corev1.Container, podSecurityContext *corev1.PodSecurityContext) []string {
+	var warnings []string
+	for i := range containers {
+		if violations := podSecurityViolations(level, &containers[i], podSecurityContext); len(violations) > 0 {
+			warnings = append(warnings, fmt.Sprintf("Pod Security %s enforced in namespace %s rejects the %s container injected by the volume permissions webhook: %s",
+				level, namespace, containers[i].Name, strings.Join(violations, ", ")))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodSecurityStrategy(t *testing.T) {
+	owned := []*chownTarget{{uid: 1001, gid: 1001, mountName: "data"}}
+	root := []*chownTarget{{uid: 0, gid: 0, mountName: "data"}}
+	relabel := &selinuxRelabel{fileType: defaultSELinuxFileType, processType: "spc_t"}
+
+	strategy, r, warnings := podSecurityStrategy("", strategyChown, owned, relabel)
+	assert.Equal(t, strategyChown, strategy)
+	assert.Equal(t, relabel, r)
+	assert.Empty(t, warnings)
+
+	strategy, r, warnings = podSecurityStrategy(podSecurityBaseline, strategyACL, owned, relabel)
+	assert.Equal(t, strategyACL, strategy, "baseline admits root containers")
+	assert.Nil(t, r, "but not spc_t")
+	assert.Len(t, warnings, 1)
+
+	strategy, _, warnings = podSecurityStrategy(podSecurityRestricted, strategyChown, owned, nil)
+	assert.Equal(t, strategyVerify, strategy)
+	assert.Len(t, warnings, 1)
+
+	strategy, _, warnings = podSecurityStrategy(podSecurityRestricted, strategyChown, root, nil)
+	assert.Equal(t, strategyChown, strategy)
+	assert.Contains(t, warnings[0], "no strategy is compatible")
+}
+
+func TestPodSecurityViolations(t *testing.T) {
+	yes, no := true, false
+	root := corev1.Container{Name: "root", SecurityContext: &corev1.SecurityContext{
+		RunAsUser:      int64Ptr(0),
+		Capabilities:   &corev1.Capabilities{Add: []corev1.Capability{"CHOWN", "SYS_ADMIN"}},
+		SELinuxOptions: &corev1.SELinuxOptions{Type: "spc_t"},
+	}}
+	assert.Equal(t, []string{"adds capability SYS_ADMIN", "runs as SELinux type spc_t"}, podSecurityViolations(podSecurityBaseline, &root, nil))
+	assert.Empty(t, podSecurityViolations(podSecurityPrivileged, &root, nil))
+
+	owner := corev1.Container{Name: "owner", SecurityContext: &corev1.SecurityContext{
+		RunAsUser:                int64Ptr(1001),
+		RunAsNonRoot:             &yes,
+		AllowPrivilegeEscalation: &no,
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+	}}
+	assert.Empty(t, podSecurityViolations(podSecurityRestricted, &owner, nil))
+	assert.Equal(t, []string{
+		"adds capability CHOWN", "adds capability SYS_ADMIN", "runs as SELinux type spc_t", "allows privilege escalation",
+		"does not drop ALL capabilities", "does not set runAsNonRoot", "runs as root", "sets no seccomp profile",
+	}, podSecurityViolations(podSecurityRestricted, &root, nil))
+}
+
+func TestEvaluatePodSecurity(t *testing.T) {
+	tmpl := func(namespace string, fsGroup int64) *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "app", Namespace: namespace, Annotations: map[string]string{admissionWebhookAnnotationSELinuxRelabelKey: "true"}},
+			spec: &corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{FSGroup: &fsGroup},
+				Containers: []corev1.Container{{
+					Name:         "app",
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				}},
+				Volumes: []corev1.Volume{
+					{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				},
+			},
+		}
+	}
+	namespace := func(name, level string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{podSecurityEnforceLabel: level}}}
+	}
+	off := false
+	m := &mutator{
+		config:     &MutationConfig{Hardening: &Hardening{DropCapabilities: &off}, SELinux: &SELinuxRelabel{InitContainerType: "spc_t"}},
+		namespaces: namespaceLister(namespace("baseline", podSecurityBaseline), namespace("restricted", podSecurityRestricted)),
+	}
+
+	t.Run("baseline", func(t *testing.T) {
+		d, err := m.evaluate(context.TODO(), tmpl("baseline", 1001))
+		assert.NoError(t, err)
+		c := d.initContainers[0]
+		assert.Contains(t, c.Command[2], "chown -R 1001:1001 /data")
+		assert.NotContains(t, c.Command[2], "chcon")
+		assert.Nil(t, c.SecurityContext.SELinuxOptions)
+		assert.Equal(t, []corev1.Capability{"ALL"}, c.SecurityContext.Capabilities.Drop, "baseline restricts the capabilities whatever the configuration")
+		assert.Len(t, d.warnings, 1)
+	})
+
+	t.Run("restricted", func(t *testing.T) {
+		d, err := m.evaluate(context.TODO(), tmpl("restricted", 1001))
+		assert.NoError(t, err)
+		c := d.initContainers[0]
+		assert.Contains(t, c.Command[2], "! -writable")
+		assert.Equal(t, int64(1001), *c.SecurityContext.RunAsUser)
+		assert.True(t, *c.SecurityContext.RunAsNonRoot)
+		assert.Empty(t, podSecurityViolations(podSecurityRestricted, &c, nil))
+		for _, w := range d.warnings {
+			assert.NotContains(t, w, "rejects the volume-permissions container")
+		}
+	})
+
+	t.Run("nothing compatible", func(t *testing.T) {
+		d, err := m.evaluate(context.TODO(), tmpl("restricted", 0))
+		assert.NoError(t, err)
+		assert.True(t, d.inject)
+		rejected := false
+		for _, w := range d.warnings {
+			rejected = rejected || strings.Contains(w, "rejects the volume-permissions container injected by the volume permissions webhook")
+		}
+		assert.True(t, rejected, "%v", d.warnings)
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// eventReasonFailed is the reason of the Events reporting a failed
+	// injected container
+	eventReasonFailed = "VolumePermissionsFailed"
+	// podWatcherLeaseName is the lease of the replica reporting the outcomes
+	podWatcherLeaseName = "volume-permissions-pod-watcher"
+
+	outcomeSucceeded = "succeeded"
+	outcomeFailed    = "failed"
+
+	// failure reasons recognized in the termination message
+	failureRootSquash  = "root-squash"
+	failureNotWritable = "not-writable"
+	failureOther       = "other"
+
+	rootSquashHint = "the volume server refuses changes made by root, typically an NFS export with root_squash: " +
+		"export it with no_root_squash, set its anonuid and anongid to the owner of the app, or use the verify strategy"
+)
+
+// applyTerminationMessagePolicy makes the kubelet fall back to the end of the
+// log of a failed injected container when it wrote no termination message, so
+// the shell template failures are reported too
+func applyTerminationMessagePolicy(containers []corev1.Container) {
+	for i := range containers {
+		if containers[i].TerminationMessagePolicy == "" {
+			containers[i].TerminationMessagePolicy = corev1.TerminationMessageFallbackToLogsOnError
+		}
+	}
+}
+
+// podWatcher reports the outcome of the injected containers of the pods the
+// webhook mutated through Events, metrics and log lines
+type podWatcher struct {
+	recorder record.EventRecorder
+	metrics  *outcomeMetrics
+	// since skips the terminations before the watcher started, the previous
+	// webhook process reported them
+	since time.Time
+
+	mu sync.Mutex
+	// reported holds the terminations already reported per pod
+	reported map[types.UID]map[string]bool
+}
+
+func newPodWatcher(recorder record.EventRecorder) *podWatcher {
+	return &podWatcher{
+		recorder: recorder,
+		metrics:  &outcomeMetrics{counts: map[outcome]int64{}},
+		since:    time.Now(),
+		reported: map[types.UID]map[string]bool{},
+	}
+}
+
+// injectedContainer reports whether the container is one the webhook injects
+func injectedContainer(name string) bool {
+	return name == initContainerName || strings.HasPrefix(name, initContainerName+"-")
+}
+
+// observe reports the terminations of the injected containers of the pod
+// that were not reported yet
+func (w *podWatcher) observe(pod *corev1.Pod) {
+	if pod.Annotations[admissionWebhookAnnotationStatusKey] != "injected" {
+		return
+	}
+	for _, status := range pod.Status.InitContainerStatuses {
+		if !injectedContainer(status.Name) {
+			continue
+		}
+		for _, term := range []*corev1.ContainerStateTerminated{status.LastTerminationState.Terminated, status.State.Terminated} {
+			if term == nil || term.FinishedAt.Time.Before(w.since) || !w.firstReport(pod.UID, fmt.Sprintf("%s/%s/%s", status.Name, term.ContainerID, term.FinishedAt.UTC().Format(time.RFC3339))) {
+				continue
+			}
+			w.report(pod, status.Name, term)
+		}
+	}
+}
+
+func (w *podWatcher) firstReport(uid types.UID, termination string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.reported[uid] == nil {
+		w.reported[uid] = map[string]bool{}
+	}
+	if w.reported[uid][termination] {
+		return false
+	}
+	w.reported[uid][termination] = true
+	return true
+}
+
+func (w *podWatcher) forget(uid types.UID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.reported, uid)
+}
+
+func (w *podWatcher) report(pod *corev1.Pod, container string, term *corev1.ContainerStateTerminated) {
+	if term.ExitCode == 0 {
+		w.metrics.inc(outcome{result: outcomeSucceeded})
+		glog.Infof("Init container %s of %s/%s succeeded: %s", container, pod.Namespace, pod.Name, strings.TrimSpace(term.Message))
+		return
+	}
+	reason, hint := classifyFailure(term.Message)
+	w.metrics.inc(outcome{result: outcomeFailed, reason: reason})
+	message := fmt.Sprintf("init container %s exited with %d: %s", container, term.ExitCode, strings.TrimSpace(term.Message))
+	if hint != "" {
+		message += "; " + hint
+	}
+	glog.Warningf("Pod %s/%s: %s", pod.Namespace, pod.Name, message)
+	w.recorder.Event(pod, corev1.EventTypeWarning, eventReasonFailed, message)
+}
+
+// classifyFailure recognizes the cause of a failure from the termination
+// message and returns a hint for the causes that have one
+func classifyFailure(message string) (string, string) {
+	switch lower := strings.ToLower(message); {
+	case strings.Contains(lower, "operation not permitted"):
+		return failureRootSquash, rootSquashHint
+	case strings.Contains(lower, "not writable by"):
+		return failureNotWritable, ""
+	}
+	return failureOther, ""
+}
+
+// run watches the pods until the context is done
+func (w *podWatcher) run(ctx context.Context, clientset kubernetes.Interface, resync time.Duration) {
+	factory := informers.NewSharedInformerFactory(clientset, resync)
+	factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				w.observe(pod)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				w.observe(pod)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*corev1.Pod); ok {
+				w.forget(pod.UID)
+			}
+		},
+	})
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+}
+
+// newEventRecorder returns a recorder writing Events through the clientset
+func newEventRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(runtimeScheme, corev1.EventSource{Component: "volume-permissions-container-injector"})
+}
+
+// outcome labels the outcome counter
+type outcome struct {
+	result string
+	reason string
+}
+
+// outcomeMetrics counts the outcomes of the injected containers
+type outcomeMetrics struct {
+	mu     sync.Mutex
+	counts map[outcome]int64
+}
+
+func (m *outcomeMetrics) inc(o outcome) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[o]++
+}
+
+// writeTo writes the counters in the Prometheus text format
+func (m *outcomeMetrics) writeTo(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lines := make([]string, 0, len(m.counts))
+	for o, n := range m.counts {
+		labels := fmt.Sprintf(`result=%q`, o.result)
+		if o.reason != "" {
+			labels += fmt.Sprintf(`,reason=%q`, o.reason)
+		}
+		lines = append(lines, fmt.Sprintf("volume_permissions_init_container_outcomes_total{%s} %d", labels, n))
+	}
+	sort.Strings(lines)
+	fmt.Fprintln(out, "# HELP volume_permissions_init_container_outcomes_total Terminations of the injected volume-permissions containers.")
+	fmt.Fprintln(out, "# TYPE volume_permissions_init_container_outcomes_total counter")
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+}
+
+func (m *outcomeMetrics) serve(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestPodWatcher(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	w := newPodWatcher(recorder)
+	w.since = time.Time{}
+
+	finished := metav1.NewTime(time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC))
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "redis-0",
+			Namespace:   "sentry-pro",
+			UID:         "redis-0-uid",
+			Annotations: map[string]string{admissionWebhookAnnotationStatusKey: "injected"},
+		},
+		Status: corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{{
+			Name: initContainerName,
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+				ExitCode:    1,
+				ContainerID: "containerd://1",
+				FinishedAt:  finished,
+				Message:     "chown: changing ownership of '/bitnami/redis/data': Operation not permitted\n",
+			}},
+		}}},
+	}
+
+	w.observe(pod)
+	w.observe(pod)
+	if assert.Len(t, recorder.Events, 1, "a termination is reported once") {
+		event := <-recorder.Events
+		assert.Contains(t, event, "Warning VolumePermissionsFailed init container volume-permissions exited with 1: chown: changing ownership of '/bitnami/redis/data': Operation not permitted")
+		assert.Contains(t, event, "root_squash")
+	}
+
+	pod.Status.InitContainerStatuses[0].LastTerminationState = pod.Status.InitContainerStatuses[0].State
+	pod.Status.InitContainerStatuses[0].State = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+		ContainerID: "containerd://2",
+		FinishedAt:  metav1.NewTime(finished.Add(time.Minute)),
+		Message:     `{"checked":12,"changed":12,"errors":0,"duration":"3ms"}`,
+	}}
+	w.observe(pod)
+	assert.Empty(t, recorder.Events, "successes are not Events")
+
+	notInjected := pod.DeepCopy()
+	notInjected.UID, notInjected.Annotations = "other", nil
+	w.observe(notInjected)
+
+	var out bytes.Buffer
+	w.metrics.writeTo(&out)
+	assert.Equal(t, `# HELP volume_permissions_init_container_outcomes_total Terminations of the injected volume-permissions containers.
+# TYPE volume_permissions_init_container_outcomes_total counter
+volume_permissions_init_container_outcomes_total{result="failed",reason="root-squash"} 1
+volume_permissions_init_container_outcomes_total{result="succeeded"} 1
+`, out.String())
+}
+
+func TestPodWatcherSkipsEarlierTerminations(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	w := newPodWatcher(recorder)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{UID: "uid", Annotations: map[string]string{admissionWebhookAnnotationStatusKey: "injected"}},
+		Status: corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{{
+			Name:  initContainerName + "-2",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, FinishedAt: metav1.NewTime(w.since.Add(-time.Hour))}},
+		}}},
+	}
+	w.observe(pod)
+	assert.Empty(t, recorder.Events)
+}
+
+func TestClassifyFailure(t *testing.T) {
+	reason, hint := classifyFailure(`{"errors":3,"failures":["lchown /data/db: operation not permitted"]}`)
+	assert.Equal(t, failureRootSquash, reason)
+	assert.Equal(t, rootSquashHint, hint)
+	reason, _ = classifyFailure("not writable by 1001:1001: /data/db")
+	assert.Equal(t, failureNotWritable, reason)
+	reason, hint = classifyFailure("")
+	assert.Equal(t, failureOther, reason)
+	assert.Empty(t, hint)
+}
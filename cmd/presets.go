@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// admissionWebhookAnnotationPresetsKey records the ownership presets applied
+// to the containers of a pod
+const admissionWebhookAnnotationPresetsKey = "volume-permissions-container-injector-webhook.malston.me/ownership-presets"
+
+// OwnershipPreset is the owner of the volumes of containers running an image
+// with a well-known user, used when neither the container nor the pod
+// declares a user or group
+type OwnershipPreset struct {
+	// Name identifies the preset in the ownership-presets annotation
+	Name string `json:"name"`
+	// Images are image patterns, * matching any run of characters. A pattern
+	// matches the whole image reference or its repository without tag and
+	// digest.
+	Images []string `json:"images"`
+	UID    int64    `json:"uid"`
+	GID    int64    `json:"gid"`
+	// Mode is an optional mode change of the volumes, octal or symbolic like
+	// g+rwX
+	Mode string `json:"mode,omitempty"`
+}
+
+// defaultOwnershipPresets are the users of widely used images, the first
+// matching preset applies
+var defaultOwnershipPresets = []OwnershipPreset{
+	{Name: "bitnami", Images: []string{"bitnami/*", "*/bitnami/*"}, UID: 1001, GID: 1001},
+	{Name: "postgres-alpine", Images: []string{"postgres:*alpine*", "*/postgres:*alpine*"}, UID: 70, GID: 70},
+	{Name: "postgres", Images: []string{"postgres", "*/postgres"}, UID: 999, GID: 999},
+	{Name: "mysql", Images: []string{"mysql", "*/mysql", "mariadb", "*/mariadb"}, UID: 999, GID: 999},
+	{Name: "mongo", Images: []string{"mongo", "*/mongo"}, UID: 999, GID: 999},
+	{Name: "elasticsearch", Images: []string{"*elasticsearch/elasticsearch", "elasticsearch", "*/elasticsearch"}, UID: 1000, GID: 0},
+	{Name: "grafana", Images: []string{"grafana/grafana*", "*/grafana/grafana*"}, UID: 472, GID: 0},
+}
+
+func (cfg *MutationConfig) ownershipPresets() []OwnershipPreset {
+	if cfg == nil || cfg.OwnershipPresets == nil {
+		return defaultOwnershipPresets
+	}
+	return cfg.OwnershipPresets
+}
+
+// imageRepository strips the tag and digest from an image reference
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	// a colon after the last slash starts the tag, one before it belongs to
+	// the registry port
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// presetFor returns the first preset matching the image, or nil
+func presetFor(presets []OwnershipPreset, image string) *OwnershipPreset {
+	repository := imageRepository(image)
+	for i := range presets {
+		if matchAny(presets[i].Images, image) || matchAny(presets[i].Images, repository) {
+			return &presets[i]
+		}
+	}
+	return nil
+}
+
+func validatePresets(presets []OwnershipPreset) error {
+	for _, p := range presets {
+		if p.Name == "" || len(p.Images) == 0 {
+			return fmt.Errorf("presets need a name and images")
+		}
+		if p.UID < 0 || p.GID < 0 {
+			return fmt.Errorf("preset %s: negative uid or gid", p.Name)
+		}
+		if p.Mode != "" {
+			if _, err := parseModeSpec(p.Mode); err != nil {
+				return fmt.Errorf("preset %s: %v", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// appliedPresets describes the presets the owners come from as
+// container=preset pairs
+func appliedPresets(owners []mountOwner) string {
+	var applied []string
+	for _, o := range owners {
+		if o.preset == "" {
+			continue
+		}
+		pair := o.container + "=" + o.preset
+		if len(applied) == 0 || applied[len(applied)-1] != pair {
+			applied = append(applied, pair)
+		}
+	}
+	return strings.Join(applied, ",")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestImageRepository(t *testing.T) {
+	assert.Equal(t, "postgres", imageRepository("postgres:10.16-alpine"))
+	assert.Equal(t, "docker.io/bitnami/redis", imageRepository("docker.io/bitnami/redis:4.0.11-debian-9"))
+	assert.Equal(t, "registry:5000/team/app", imageRepository("registry:5000/team/app"))
+	assert.Equal(t, "registry:5000/team/app", imageRepository("registry:5000/team/app:v1@sha256:7b8b829e"))
+}
+
+func TestPresetFor(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "docker.io/bitnami/redis:4.0.11-debian-9", want: "bitnami"},
+		{image: "bitnami/postgresql:11", want: "bitnami"},
+		{image: "postgres:10.16-alpine", want: "postgres-alpine"},
+		{image: "docker.io/library/postgres:13", want: "postgres"},
+		{image: "postgres", want: "postgres"},
+		{image: "minio/minio:RELEASE.2021-05-11T23-27-41Z"},
+		{image: "sentry:9.1.1"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if preset := presetFor(defaultOwnershipPresets, tt.image); preset != nil {
+			got = preset.Name
+		}
+		assert.Equal(t, tt.want, got, tt.image)
+	}
+}
+
+func TestEvaluateOwnershipPresets(t *testing.T) {
+	tmpl := func(image string, psc *corev1.PodSecurityContext) *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "minio", Namespace: "kotsadm"},
+			spec: &corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name:         "minio",
+					Image:        image,
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/export"}},
+				}},
+				SecurityContext: psc,
+				Volumes: []corev1.Volume{
+					{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				},
+			},
+		}
+	}
+	m := &mutator{config: &MutationConfig{OwnershipPresets: []OwnershipPreset{
+		{Name: "minio", Images: []string{"minio/minio"}, UID: 1000, GID: 1000, Mode: "g+rwX"},
+	}}}
+
+	d, err := m.evaluate(context.TODO(), tmpl("minio/minio:RELEASE.2021-05-11T23-27-41Z", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1000:1000 /export"}, targetStrings(d.targets))
+	assert.Equal(t, "chown -R 1000:1000 /export\nchmod -R g+rwX /export", d.initContainers[0].Command[2])
+	assert.Equal(t, "minio=minio", d.annotations[admissionWebhookAnnotationPresetsKey])
+
+	d, err = m.evaluate(context.TODO(), tmpl("minio/minio:RELEASE.2021-05-11T23-27-41Z", &corev1.PodSecurityContext{FSGroup: int64Ptr(2000)}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2000:2000 /export"}, targetStrings(d.targets), "declared owners win over presets")
+	assert.NotContains(t, d.annotations, admissionWebhookAnnotationPresetsKey)
+
+	d, err = m.evaluate(context.TODO(), tmpl("docker.io/bitnami/minio:2021", nil))
+	assert.NoError(t, err)
+	assert.False(t, d.inject, "configured presets replace the built-in ones")
+}
+
+func TestValidatePresets(t *testing.T) {
+	_, err := parseMutationConfig([]byte("ownershipPresets:\n- name: app\n  images: [app]\n  uid: 1000\n  gid: 1000\n  mode: g+s\n"))
+	assert.Error(t, err)
+	_, err = parseMutationConfig([]byte("ownershipPresets:\n- images: [app]\n"))
+	assert.Error(t, err)
+	cfg, err := parseMutationConfig([]byte("ownershipPresets: []\n"))
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.ownershipPresets())
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// claimAnnotationOwnerKey, claimAnnotationModeKey,
+	// claimAnnotationPathsKey and claimAnnotationFixedAtKey record on a claim
+	// the owner and mode its last fix applied, the path options selecting the
+	// entries fixed and when. Removing or changing the owner forces a new fix.
+	claimAnnotationOwnerKey   = "volume-permissions-container-injector-webhook.malston.me/owner"
+	claimAnnotationModeKey    = "volume-permissions-container-injector-webhook.malston.me/mode"
+	claimAnnotationPathsKey   = "volume-permissions-container-injector-webhook.malston.me/paths"
+	claimAnnotationFixedAtKey = "volume-permissions-container-injector-webhook.malston.me/fixed-at"
+	// claimAnnotationFixFailedKey records on a claim the fix, owner and path
+	// options, a Job of the controller failed to apply. The controller starts
+	// no Job for the same fix again until it is removed.
+	claimAnnotationFixFailedKey = "volume-permissions-container-injector-webhook.malston.me/fix-failed"
+
+	// podNameReference is expanded by the kubelet in the injected container
+	// arguments, it names the claims of per pod volumes
+	podNameReference = "$(POD_NAME)"
+)
+
+// assignClaims names the claim of every target covering a whole claim:
+// claims of the pod volumes, the claims the StatefulSet controller creates
+// from claim templates and those of generic ephemeral volumes. Targets on a
+// subPath are part of a claim and are not recorded.
+func assignClaims(tmpl *podTemplate, targets []*chownTarget) {
+	claims := map[string]string{}
+	for _, v := range tmpl.volumes() {
+		switch {
+		case tmpl.claimTemplate(v.Name) != nil:
+			claims[v.Name] = v.Name + "-" + podNameReference
+		case v.PersistentVolumeClaim != nil:
+			claims[v.Name] = v.PersistentVolumeClaim.ClaimName
+		case v.Ephemeral != nil:
+			claims[v.Name] = podNameReference + "-" + v.Name
+		}
+	}
+	for _, t := range targets {
+		if t.subPath == "" && t.subPathExpr == "" {
+			t.claim = claims[t.mountName]
+		}
+	}
+}
+
+func recordOwner(uid, gid int64) string {
+	return fmt.Sprintf("%d:%d", uid, gid)
+}
+
+// recordFailedFix describes the fix recorded as failed on a claim
+func recordFailedFix(owner, paths string) string {
+	return owner + " " + paths
+}
+
+func recordMode(t *chownTarget) string {
+	return t.modeChange()
+}
+
+// claimRecorded reports whether the claim annotations record the owner, the
+// mode and the path options
+func claimRecorded(annotations map[string]string, owner, mode, paths string) bool {
+	return annotations[claimAnnotationOwnerKey] == owner && annotations[claimAnnotationModeKey] == mode &&
+		annotations[claimAnnotationPathsKey] == paths
+}
+
+// recordFixes names the claims the fixperms init container records its fixes
+// on and drops the targets whose claim already records the same fix. It
+// returns why the pod is skipped when no target is left.
+func (m *mutator) recordFixes(ctx context.Context, tmpl *podTemplate, d *decision, template string, paths *PathOptions) string {
+	if !strings.Contains(template, "replace-args") {
+		d.warnings = append(d.warnings, "recording fixes needs the fixperms init container, configure a fixpermsImage")
+		return ""
+	}
+	assignClaims(tmpl, d.targets)
+	if m.clientset == nil {
+		return ""
+	}
+
+	var targets []*chownTarget
+	var recorded []string
+	for _, t := range d.targets {
+		if t.claim == "" || strings.Contains(t.claim, podNameReference) {
+			targets = append(targets, t)
+			continue
+		}
+		claim, err := m.clientset.CoreV1().PersistentVolumeClaims(tmpl.meta.Namespace).Get(ctx, t.claim, metav1.GetOptions{})
+		if err != nil {
+			glog.Warningf("Could not look up claim %s/%s: %v", tmpl.meta.Namespace, t.claim, err)
+			targets = append(targets, t)
+			continue
+		}
+		if !claimRecorded(claim.Annotations, recordOwner(t.uid, t.gid), recordMode(t), paths.record()) {
+			targets = append(targets, t)
+			continue
+		}
+		glog.Infof("Claim %s/%s already fixed to %s at %s", tmpl.meta.Namespace, t.claim, claim.Annotations[claimAnnotationOwnerKey], claim.Annotations[claimAnnotationFixedAtKey])
+		recorded = append(recorded, t.claim)
+	}
+	if len(targets) == 0 {
+		return "claims already fixed: " + strings.Join(recorded, ", ")
+	}
+	d.targets = targets
+	return ""
+}
+
+// claimRecorder reads and writes the fixes recorded on claims
+type claimRecorder struct {
+	clientset kubernetes.Interface
+	namespace string
+}
+
+func (r *claimRecorder) recorded(ctx context.Context, claim, owner, mode, paths string) (bool, error) {
+	pvc, err := r.clientset.CoreV1().PersistentVolumeClaims(r.namespace).Get(ctx, claim, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return claimRecorded(pvc.Annotations, owner, mode, paths), nil
+}
+
+func (r *claimRecorder) record(ctx context.Context, claim, owner, mode, paths string) error {
+	// a fix applied clears the failure of an earlier one
+	annotations := map[string]interface{}{
+		claimAnnotationOwnerKey:     owner,
+		claimAnnotationModeKey:      nil,
+		claimAnnotationPathsKey:     paths,
+		claimAnnotationFixFailedKey: nil,
+		claimAnnotationFixedAtKey:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if mode != "" {
+		annotations[claimAnnotationModeKey] = mode
+	}
+	return r.patch(ctx, claim, annotations)
+}
+
+// recordFailure records on the claim the fix that failed
+func (r *claimRecorder) recordFailure(ctx context.Context, claim, fix string) error {
+	return r.patch(ctx, claim, map[string]interface{}{claimAnnotationFixFailedKey: fix})
+}
+
+func (r *claimRecorder) patch(ctx context.Context, claim string, annotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+	if err != nil {
+		return err
+	}
+	_, err = r.clientset.CoreV1().PersistentVolumeClaims(r.namespace).Patch(ctx, claim, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
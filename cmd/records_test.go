@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAssignClaims(t *testing.T) {
+	tmpl := &podTemplate{
+		spec: &corev1.PodSpec{Volumes: []corev1.Volume{
+			{Name: "shared", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "media"}}},
+			{Name: "scratch", VolumeSource: corev1.VolumeSource{Ephemeral: &corev1.EphemeralVolumeSource{}}},
+		}},
+		claimTemplates: []corev1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "data"}}},
+	}
+	targets := []*chownTarget{
+		{mountName: "shared", mountPath: "/srv/media"},
+		{mountName: "shared", mountPath: "/srv/static", subPath: "static"},
+		{mountName: "scratch", mountPath: "/scratch"},
+		{mountName: "data", mountPath: "/data"},
+	}
+	assignClaims(tmpl, targets)
+	assert.Equal(t, "media", targets[0].claim)
+	assert.Empty(t, targets[1].claim, "part of a claim")
+	assert.Equal(t, "$(POD_NAME)-scratch", targets[2].claim)
+	assert.Equal(t, "data-$(POD_NAME)", targets[3].claim)
+}
+
+func TestEvaluateRecordFixes(t *testing.T) {
+	tmpl := func() *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "web", Namespace: "sentry-pro"},
+			spec: &corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name:         "web",
+					VolumeMounts: []corev1.VolumeMount{{Name: "shared", MountPath: "/srv/media"}},
+				}},
+				SecurityContext: &corev1.PodSecurityContext{FSGroup: int64Ptr(1001)},
+				Volumes: []corev1.Volume{
+					{Name: "shared", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "media"}}},
+				},
+			},
+		}
+	}
+	claim := func(annotations map[string]string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "media", Namespace: "sentry-pro", Annotations: annotations}}
+	}
+	cfg := &MutationConfig{
+		FixpermsImage: "docker.io/malston/volume-permissions-container-injector:v1",
+		RecordFixes:   true,
+	}
+
+	t.Run("unrecorded claim is fixed and recorded", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(claim(nil))
+		d, err := (&mutator{config: cfg, clientset: clientset}).evaluate(context.TODO(), tmpl())
+		assert.NoError(t, err)
+		assert.True(t, d.inject)
+		c := d.initContainers[0]
+		assert.Equal(t, []string{"-uid=1001", "-gid=1001", "-mode=", "-claim=media", "/srv/media"}, c.Args)
+		assert.True(t, hasEnv(c.Env, "POD_NAMESPACE"))
+	})
+
+	full := (*PathOptions)(nil).record()
+	t.Run("recorded claim is skipped", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(claim(map[string]string{claimAnnotationOwnerKey: "1001:1001", claimAnnotationPathsKey: full}))
+		d, err := (&mutator{config: cfg, clientset: clientset}).evaluate(context.TODO(), tmpl())
+		assert.NoError(t, err)
+		assert.False(t, d.inject)
+		assert.Equal(t, "claims already fixed: media", d.reason)
+	})
+
+	t.Run("claim recording another owner is fixed again", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(claim(map[string]string{claimAnnotationOwnerKey: "999:999"}))
+		d, err := (&mutator{config: cfg, clientset: clientset}).evaluate(context.TODO(), tmpl())
+		assert.NoError(t, err)
+		assert.True(t, d.inject)
+	})
+
+	t.Run("claim recording other path options is fixed again", func(t *testing.T) {
+		shallow := &PathOptions{MaxDepth: new(int)}
+		clientset := fake.NewSimpleClientset(claim(map[string]string{claimAnnotationOwnerKey: "1001:1001", claimAnnotationPathsKey: shallow.record()}))
+		d, err := (&mutator{config: cfg, clientset: clientset}).evaluate(context.TODO(), tmpl())
+		assert.NoError(t, err)
+		assert.True(t, d.inject, "a fix of the root only does not stand for a full one")
+	})
+
+	t.Run("shell template", func(t *testing.T) {
+		d, err := (&mutator{config: &MutationConfig{RecordFixes: true}}).evaluate(context.TODO(), tmpl())
+		assert.NoError(t, err)
+		assert.True(t, d.inject)
+		assert.Contains(t, d.warnings[0], "recording fixes needs the fixperms init container")
+	})
+}
+
+func TestClaimRecorder(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "media", Namespace: "sentry-pro"}})
+	r := &claimRecorder{clientset: clientset, namespace: "sentry-pro"}
+
+	recorded, err := r.recorded(context.TODO(), "media", "1001:1001", groupWritableMode, "include= exclude= max-depth=-1 xdev=false")
+	assert.NoError(t, err)
+	assert.False(t, recorded)
+
+	assert.NoError(t, r.record(context.TODO(), "media", "1001:1001", groupWritableMode, "include= exclude= max-depth=-1 xdev=false"))
+	recorded, err = r.recorded(context.TODO(), "media", "1001:1001", groupWritableMode, "include= exclude= max-depth=-1 xdev=false")
+	assert.NoError(t, err)
+	assert.True(t, recorded)
+
+	assert.NoError(t, r.record(context.TODO(), "media", "1001:1001", "", "include= exclude=lost+found max-depth=-1 xdev=false"))
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims("sentry-pro").Get(context.TODO(), "media", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, pvc.Annotations, claimAnnotationModeKey, "recording no mode change drops the recorded one")
+	assert.Equal(t, "include= exclude=lost+found max-depth=-1 xdev=false", pvc.Annotations[claimAnnotationPathsKey])
+	assert.NotEmpty(t, pvc.Annotations[claimAnnotationFixedAtKey])
+
+	recorded, err = r.recorded(context.TODO(), "missing", "1001:1001", "", "")
+	assert.NoError(t, err)
+	assert.False(t, recorded)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// admissionWebhookAnnotationSELinuxRelabelKey switches the SELinux relabel
+	// on or off for a pod, overriding the configuration
+	admissionWebhookAnnotationSELinuxRelabelKey = "volume-permissions-container-injector-webhook.malston.me/selinux-relabel"
+
+	defaultSELinuxFileType = "container_file_t"
+)
+
+var (
+	// selinuxTypePattern and selinuxLevelPattern are the SELinux types and
+	// MLS levels, like s0-s0:c0.c1023, accepted in the chcon options
+	selinuxTypePattern  = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	selinuxLevelPattern = regexp.MustCompile(`^s[0-9]+(-s[0-9]+)?(:c[0-9]+([.,]c[0-9]+)*)?$`)
+)
+
+// SELinuxRelabel configures the relabel of the fixed entries so containers
+// confined by SELinux may access them
+type SELinuxRelabel struct {
+	// Enabled relabels the volumes of every pod, pods opt in or out with the
+	// selinux-relabel annotation
+	Enabled bool `json:"enabled,omitempty"`
+	// Type is the SELinux type of the relabeled entries, container_file_t when
+	// unset
+	Type string `json:"type,omitempty"`
+	// Level is the SELinux level of the relabeled entries when the pod
+	// securityContext sets none. Entries keep their level when both are unset.
+	Level string `json:"level,omitempty"`
+	// InitContainerType is the SELinux type the injected container runs as, it
+	// must be allowed to relabel files. The container runtime picks the type
+	// when unset; no unconfined type like spc_t is chosen for the operator.
+	InitContainerType string `json:"initContainerType,omitempty"`
+}
+
+// selinuxRelabel is the relabel applied to the volumes of one pod
+type selinuxRelabel struct {
+	fileType string
+	level    string
+	// processType is empty unless configured, the injected containers then
+	// run as the type the template or the runtime gives them
+	processType string
+}
+
+// selinuxRelabelFor returns the relabel of the pod's volumes, or nil when the
+// configuration and the pod annotation leave it switched off. The level comes
+// from the pod's SELinuxOptions, falling back to the configured level.
+func selinuxRelabelFor(cfg *MutationConfig, annotations map[string]string, podSecurityContext *corev1.PodSecurityContext) (*selinuxRelabel, error) {
+	var settings SELinuxRelabel
+	if cfg != nil && cfg.SELinux != nil {
+		settings = *cfg.SELinux
+	}
+	if v, ok := annotations[admissionWebhookAnnotationSELinuxRelabelKey]; ok {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q: %v", admissionWebhookAnnotationSELinuxRelabelKey, v, err)
+		}
+		settings.Enabled = enabled
+	}
+	if !settings.Enabled {
+		return nil, nil
+	}
+
+	relabel := &selinuxRelabel{
+		fileType:    settings.Type,
+		level:       settings.Level,
+		processType: settings.InitContainerType,
+	}
+	if relabel.fileType == "" {
+		relabel.fileType = defaultSELinuxFileType
+	}
+	if podSecurityContext != nil && podSecurityContext.SELinuxOptions != nil && podSecurityContext.SELinuxOptions.Level != "" {
+		relabel.level = podSecurityContext.SELinuxOptions.Level
+	}
+	for _, t := range []string{relabel.fileType, relabel.processType} {
+		if t != "" && !selinuxTypePattern.MatchString(t) {
+			return nil, fmt.Errorf("invalid SELinux type %q", t)
+		}
+	}
+	if relabel.level != "" && !selinuxLevelPattern.MatchString(relabel.level) {
+		return nil, fmt.Errorf("invalid SELinux level %q", relabel.level)
+	}
+	return relabel, nil
+}
+
+// chconArgs returns the chcon options setting the type and level
+func (r *selinuxRelabel) chconArgs() string {
+	args := "-t " + shellQuote(r.fileType)
+	if r.level != "" {
+		args += " -l " + shellQuote(r.level)
+	}
+	return args
+}
+
+// applyProcessContext runs the injected containers as the configured SELinux
+// type that is allowed to relabel, keeping the other SELinux options of the
+// template. Nothing is changed without a configured type.
+func (r *selinuxRelabel) applyProcessContext(containers []corev1.Container) {
+	if r.processType == "" {
+		return
+	}
+	for i := range containers {
+		c := &containers[i]
+		if c.SecurityContext == nil {
+			c.SecurityContext = &corev1.SecurityContext{}
+		}
+		if c.SecurityContext.SELinuxOptions == nil {
+			c.SecurityContext.SELinuxOptions = &corev1.SELinuxOptions{}
+		}
+		c.SecurityContext.SELinuxOptions.Type = r.processType
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSELinuxRelabelFor(t *testing.T) {
+	enabled := &MutationConfig{SELinux: &SELinuxRelabel{Enabled: true, Level: "s0"}}
+	podLevel := &corev1.PodSecurityContext{SELinuxOptions: &corev1.SELinuxOptions{Level: "s0:c123,c456"}}
+	optOut := map[string]string{admissionWebhookAnnotationSELinuxRelabelKey: "false"}
+	optIn := map[string]string{admissionWebhookAnnotationSELinuxRelabelKey: "true"}
+
+	tests := []struct {
+		name        string
+		cfg         *MutationConfig
+		annotations map[string]string
+		psc         *corev1.PodSecurityContext
+		want        *selinuxRelabel
+	}{
+		{name: "disabled by default"},
+		{name: "configured level", cfg: enabled, want: &selinuxRelabel{fileType: "container_file_t", level: "s0"}},
+		{name: "pod level", cfg: enabled, psc: podLevel, want: &selinuxRelabel{fileType: "container_file_t", level: "s0:c123,c456"}},
+		{name: "pod opts out", cfg: enabled, annotations: optOut},
+		{name: "pod opts in", annotations: optIn, want: &selinuxRelabel{fileType: "container_file_t"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selinuxRelabelFor(tt.cfg, tt.annotations, tt.psc)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := selinuxRelabelFor(nil, map[string]string{admissionWebhookAnnotationSELinuxRelabelKey: "maybe"}, nil)
+	assert.Error(t, err)
+
+	for _, level := range []string{"s0; rm -rf /", "s0:c1 c2", "$(id)"} {
+		_, err = selinuxRelabelFor(enabled, nil, &corev1.PodSecurityContext{SELinuxOptions: &corev1.SELinuxOptions{Level: level}})
+		assert.Error(t, err, level)
+	}
+	_, err = selinuxRelabelFor(&MutationConfig{SELinux: &SELinuxRelabel{Enabled: true, Type: "container_file_t'"}}, nil, nil)
+	assert.Error(t, err)
+	_, err = selinuxRelabelFor(&MutationConfig{SELinux: &SELinuxRelabel{Enabled: true, InitContainerType: "spc_t; id"}}, nil, nil)
+	assert.Error(t, err)
+	_, err = selinuxRelabelFor(enabled, nil, &corev1.PodSecurityContext{SELinuxOptions: &corev1.SELinuxOptions{Level: "s0-s0:c0.c1023"}})
+	assert.NoError(t, err)
+}
+
+func TestEvaluateSELinuxRelabel(t *testing.T) {
+	tmpl := &podTemplate{
+		meta: &metav1.ObjectMeta{Name: "nfs-app", Namespace: "sentry-pro"},
+		spec: &corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:         "app",
+				VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+			}},
+			SecurityContext: &corev1.PodSecurityContext{
+				FSGroup:        int64Ptr(1001),
+				SELinuxOptions: &corev1.SELinuxOptions{Level: "s0:c123,c456"},
+			},
+			Volumes: []corev1.Volume{
+				{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+			},
+		},
+	}
+	m := &mutator{config: &MutationConfig{SELinux: &SELinuxRelabel{Enabled: true}}}
+
+	d, err := m.evaluate(context.TODO(), tmpl)
+	assert.NoError(t, err)
+	c := d.initContainers[0]
+	assert.Equal(t, []string{"/bin/bash", "-ec", "chown -R 1001:1001 /data\nchcon -R -t 'container_file_t' -l 's0:c123,c456' /data"}, c.Command)
+	assert.Nil(t, c.SecurityContext.SELinuxOptions, "the runtime picks the type unless one is configured")
+
+	m.config.SELinux.InitContainerType = "spc_t"
+	d, err = m.evaluate(context.TODO(), tmpl)
+	assert.NoError(t, err)
+	assert.Equal(t, &corev1.SELinuxOptions{Type: "spc_t"}, d.initContainers[0].SecurityContext.SELinuxOptions)
+	assert.Equal(t, int64(0), *c.SecurityContext.RunAsUser)
+}
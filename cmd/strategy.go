@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// admissionWebhookAnnotationStrategyKey selects the strategy for a pod,
+	// overriding the configuration
+	admissionWebhookAnnotationStrategyKey = "volume-permissions-container-injector-webhook.malston.me/strategy"
+
+	// strategyChown changes the owner of the volume entries
+	strategyChown = "chown"
+	// strategyACL grants the owner access with POSIX ACLs and leaves the
+	// owner as is, for volumes shared with apps running as other users
+	strategyACL = "acl"
+	// strategyVerify changes nothing, it fails the pod with a termination
+	// message naming the entries the owner cannot write
+	strategyVerify = "verify"
+)
+
+// defaultACLImages are init container images known to ship setfacl
+var defaultACLImages = []string{"*bitnami/bitnami-shell*", "*bitnami/os-shell*"}
+
+func validStrategy(strategy string) error {
+	switch strategy {
+	case strategyChown, strategyACL, strategyVerify:
+		return nil
+	}
+	return fmt.Errorf("unsupported strategy %q, expect %s, %s or %s", strategy, strategyChown, strategyACL, strategyVerify)
+}
+
+// strategyFor returns the configured strategy unless the pod annotation
+// selects another one
+func strategyFor(cfg *MutationConfig, annotations map[string]string) (string, error) {
+	if v, ok := annotations[admissionWebhookAnnotationStrategyKey]; ok {
+		strategy := strings.TrimSpace(v)
+		if err := validStrategy(strategy); err != nil {
+			return "", fmt.Errorf("invalid %s annotation: %v", admissionWebhookAnnotationStrategyKey, err)
+		}
+		return strategy, nil
+	}
+	if cfg == nil || cfg.Strategy == "" {
+		return strategyChown, nil
+	}
+	return cfg.Strategy, nil
+}
+
+// selectStrategy settles the fix of a pod from the options it asked for. The
+// Pod Security level of the namespace comes first, then the non-root
+// requirement of the pod; either may switch the pod to the verify strategy,
+// which samples the volumes and relabels nothing. The warnings tell what was
+// changed, the error why the pod is denied.
+func (cfg *MutationConfig) selectStrategy(level string, nonRoot bool, requested fixOptions, targets []*chownTarget) (*fixOptions, []string, error) {
+	opts := requested
+	verify := func() {
+		opts.strategy, opts.paths, opts.relabel = strategyVerify, verifyPaths(requested.paths), nil
+	}
+	if opts.strategy == strategyVerify {
+		verify()
+	}
+
+	strategy, relabel, warnings := podSecurityStrategy(level, opts.strategy, targets, opts.relabel)
+	opts.relabel = relabel
+	if strategy != opts.strategy {
+		verify()
+	}
+	if !nonRoot {
+		return &opts, warnings, nil
+	}
+	strategy, err := cfg.nonRootStrategy(opts.strategy, targets)
+	if err != nil {
+		return nil, warnings, err
+	}
+	if strategy != opts.strategy {
+		verify()
+		warnings = append(warnings, "the pod requires non-root containers (runAsNonRoot), its volumes are verified instead of fixed")
+	}
+	return &opts, warnings, nil
+}
+
+// chownCommands returns the commands changing the owner of the target
+func chownCommands(t *chownTarget, paths *PathOptions) []string {
+	if paths.empty() {
+		commands := []string{fmt.Sprintf("chown -R %d:%d %s", t.uid, t.gid, shellWord(t.mountPath))}
+		if mode := t.modeChange(); mode != "" {
+			commands = append(commands, fmt.Sprintf("chmod -R %s %s", mode, shellWord(t.mountPath)))
+		}
+		return commands
+	}
+	commands := []string{findCommand(t.mountPath, paths, fmt.Sprintf("-exec chown -h %d:%d {} +", t.uid, t.gid))}
+	if mode := t.modeChange(); mode != "" {
+		commands = append(commands, findCommand(t.mountPath, paths, "! -type l -exec chmod "+mode+" {} +"))
+	}
+	return commands
+}
+
+// aclCommands returns the commands granting the owner of the target read and
+// write access through access ACLs on every entry and default ACLs on the
+// directories, so entries created later inherit the access
+func aclCommands(t *chownTarget, paths *PathOptions) []string {
+	entries := fmt.Sprintf("u:%d:rwX,g:%d:rwX", t.uid, t.gid)
+	if paths.empty() {
+		paths = &PathOptions{}
+	}
+	return []string{
+		findCommand(t.mountPath, paths, "! -type l -exec setfacl -m "+entries+" {} +"),
+		findCommand(t.mountPath, paths, "-type d -exec setfacl -d -m "+entries+" {} +"),
+	}
+}
+
+// aclPreflight fails the injected container with a clear message when its
+// image lacks setfacl after all
+const aclPreflight = `command -v setfacl >/dev/null || { echo "setfacl not found in the volume-permissions image" >&2; exit 1; }`
+
+func (cfg *MutationConfig) aclImages() []string {
+	if cfg == nil || cfg.ACLImages == nil {
+		return defaultACLImages
+	}
+	return cfg.ACLImages
+}
+
+// checkACLImages rejects containers whose image is not known to provide
+// setfacl
+func (cfg *MutationConfig) checkACLImages(containers []corev1.Container) error {
+	for _, c := range containers {
+		if !matchAny(cfg.aclImages(), c.Image) {
+			return fmt.Errorf("the %s strategy needs an image providing setfacl, %s is not one of the aclImages", strategyACL, c.Image)
+		}
+	}
+	return nil
+}
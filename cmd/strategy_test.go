@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStrategyFor(t *testing.T) {
+	strategy, err := strategyFor(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, strategyChown, strategy)
+
+	strategy, err = strategyFor(&MutationConfig{Strategy: strategyACL}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, strategyACL, strategy)
+
+	strategy, err = strategyFor(&MutationConfig{Strategy: strategyACL}, map[string]string{admissionWebhookAnnotationStrategyKey: "chown"})
+	assert.NoError(t, err)
+	assert.Equal(t, strategyChown, strategy)
+
+	_, err = strategyFor(nil, map[string]string{admissionWebhookAnnotationStrategyKey: "chmod"})
+	assert.Error(t, err)
+	_, err = parseMutationConfig([]byte("strategy: chmod\n"))
+	assert.Error(t, err)
+}
+
+func TestSelectStrategy(t *testing.T) {
+	owned := []*chownTarget{{uid: 1001, gid: 1001, mountName: "data"}}
+	root := []*chownTarget{{uid: 0, gid: 0, mountName: "data"}}
+	relabel := &selinuxRelabel{fileType: defaultSELinuxFileType, processType: "spc_t"}
+	requested := fixOptions{strategy: strategyChown, relabel: relabel, leaseDuration: defaultLeaseDuration}
+	verifyCfg := &MutationConfig{NonRootPolicy: nonRootPolicyVerify}
+
+	opts, warnings, err := verifyCfg.selectStrategy("", false, requested, owned)
+	assert.NoError(t, err)
+	assert.Equal(t, &requested, opts, "nothing to settle")
+	assert.Empty(t, warnings)
+
+	opts, warnings, err = (*MutationConfig)(nil).selectStrategy("", false, fixOptions{strategy: strategyVerify, relabel: relabel}, owned)
+	assert.NoError(t, err)
+	assert.Equal(t, &fixOptions{strategy: strategyVerify, paths: verifyPaths(nil)}, opts, "verifying samples the volumes and relabels nothing")
+	assert.Empty(t, warnings)
+
+	opts, warnings, err = (*MutationConfig)(nil).selectStrategy(podSecurityBaseline, true, requested, owned)
+	assert.NoError(t, err)
+	assert.Equal(t, strategyChown, opts.strategy, "the override policy keeps the fix")
+	assert.Nil(t, opts.relabel, "baseline rejects spc_t")
+	assert.Len(t, warnings, 1)
+
+	opts, warnings, err = verifyCfg.selectStrategy(podSecurityRestricted, true, requested, owned)
+	assert.NoError(t, err)
+	assert.Equal(t, &fixOptions{strategy: strategyVerify, paths: verifyPaths(nil), leaseDuration: defaultLeaseDuration}, opts)
+	assert.Len(t, warnings, 2, "the level settles first, the non-root policy has nothing left to switch")
+	assert.NotContains(t, warnings[1], "runAsNonRoot")
+
+	opts, warnings, err = verifyCfg.selectStrategy("", true, requested, owned)
+	assert.NoError(t, err)
+	assert.Equal(t, &fixOptions{strategy: strategyVerify, paths: verifyPaths(nil), leaseDuration: defaultLeaseDuration}, opts)
+	assert.Equal(t, []string{"the pod requires non-root containers (runAsNonRoot), its volumes are verified instead of fixed"}, warnings)
+
+	_, _, err = verifyCfg.selectStrategy("", true, requested, root)
+	assert.Error(t, err, "root volumes cannot be verified as their owner")
+	_, _, err = (&MutationConfig{NonRootPolicy: nonRootPolicyDeny}).selectStrategy("", true, requested, owned)
+	assert.Error(t, err)
+}
+
+func TestChownCommands(t *testing.T) {
+	target := &chownTarget{uid: 1001, gid: 1001, mountPath: "/data/$(id)", groupWritable: true}
+	assert.Equal(t, []string{`chown -R 1001:1001 '/data/$(id)'`, `chmod -R g+rwX '/data/$(id)'`}, chownCommands(target, nil))
+}
+
+func TestAclCommands(t *testing.T) {
+	target := &chownTarget{uid: 1001, gid: 2000, mountPath: "/shared"}
+	assert.Equal(t, []string{
+		`find /shared ! -type l -exec setfacl -m u:1001:rwX,g:2000:rwX {} +`,
+		`find /shared -type d -exec setfacl -d -m u:1001:rwX,g:2000:rwX {} +`,
+	}, aclCommands(target, nil))
+	assert.Equal(t, []string{
+		`find /shared \( -name '.snapshot' \) -prune -o ! -type l -exec setfacl -m u:1001:rwX,g:2000:rwX {} +`,
+		`find /shared \( -name '.snapshot' \) -prune -o -type d -exec setfacl -d -m u:1001:rwX,g:2000:rwX {} +`,
+	}, aclCommands(target, &PathOptions{Exclude: []string{".snapshot"}}))
+}
+
+func TestEvaluateACLStrategy(t *testing.T) {
+	tmpl := &podTemplate{
+		meta: &metav1.ObjectMeta{
+			Name:        "reports",
+			Namespace:   "sentry-pro",
+			Annotations: map[string]string{admissionWebhookAnnotationStrategyKey: strategyACL},
+		},
+		spec: &corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:         "app",
+				VolumeMounts: []corev1.VolumeMount{{Name: "shared", MountPath: "/shared"}},
+			}},
+			SecurityContext: &corev1.PodSecurityContext{RunAsUser: int64Ptr(1001), FSGroup: int64Ptr(2000)},
+			Volumes: []corev1.Volume{
+				{Name: "shared", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "shared"}}},
+			},
+		},
+	}
+
+	t.Run("setfacl instead of chown", func(t *testing.T) {
+		d, err := (&mutator{}).evaluate(context.TODO(), tmpl)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/bin/bash", "-ec", aclPreflight + "\n" +
+			"find /shared ! -type l -exec setfacl -m u:1001:rwX,g:2000:rwX {} +\n" +
+			"find /shared -type d -exec setfacl -d -m u:1001:rwX,g:2000:rwX {} +"}, d.initContainers[0].Command)
+	})
+
+	t.Run("image without setfacl", func(t *testing.T) {
+		m := &mutator{config: &MutationConfig{ACLImages: []string{"registry.example.com/tools/acl:*"}}}
+		d, err := m.evaluate(context.TODO(), tmpl)
+		assert.NoError(t, err)
+		assert.True(t, d.deny)
+		assert.Contains(t, d.reason, "docker.io/bitnami/bitnami-shell:10 is not one of the aclImages")
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	decisionInject = "inject"
+	decisionSkip   = "skip"
+	decisionDeny   = "deny"
+)
+
+// policyTest pairs an input object and a mutation configuration with the
+// expected decision. Expectations left empty are not checked.
+type policyTest struct {
+	Name string `json:"name"`
+	// ConfigFile is resolved relative to the test file. Config is an inline
+	// configuration, parsed and validated like the webhook does.
+	ConfigFile string            `json:"configFile,omitempty"`
+	Config     json.RawMessage   `json:"config,omitempty"`
+	Input      json.RawMessage   `json:"input"`
+	Expect     policyExpectation `json:"expect"`
+
+	file string
+}
+
+type policyExpectation struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+	// ChownTarget is checked against the first target, ChownTargets against
+	// all of them
+	ChownTarget   string            `json:"chownTarget,omitempty"`
+	ChownTargets  []string          `json:"chownTargets,omitempty"`
+	InitContainer *corev1.Container `json:"initContainer,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// runTestCommand runs the policy tests found in the given files and
+// directories and reports a diff for every failed expectation
+func runTestCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	verbose := fs.Bool("v", false, "Print passing tests as well as failing ones.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no test files or directories given")
+	}
+
+	tests, err := loadPolicyTests(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, t := range tests {
+		failures, err := t.run()
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+		if len(failures) == 0 {
+			if *verbose {
+				fmt.Fprintf(stdout, "--- PASS: %s (%s)\n", t.Name, t.file)
+			}
+			continue
+		}
+		failed++
+		fmt.Fprintf(stdout, "--- FAIL: %s (%s)\n", t.Name, t.file)
+		for _, f := range failures {
+			fmt.Fprintf(stdout, "    %s\n", strings.Replace(strings.TrimSpace(f), "\n", "\n    ", -1))
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(stdout, "FAIL: %d of %d policy tests failed\n", failed, len(tests))
+		return fmt.Errorf("%d of %d policy tests failed", failed, len(tests))
+	}
+	fmt.Fprintf(stdout, "PASS: %d policy tests\n", len(tests))
+	return nil
+}
+
+// loadPolicyTests reads every YAML document of the given files, and of the
+// .yaml and .yml files of the given directories, as a policy test
+func loadPolicyTests(paths []string) ([]*policyTest, error) {
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(p, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+
+	var tests []*policyTest
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for i, doc := range splitYAMLDocuments(data) {
+			t := &policyTest{file: file}
+			if err := yaml.Unmarshal(doc, t); err != nil {
+				return nil, fmt.Errorf("%s: document %d: %v", file, i+1, err)
+			}
+			if t.Name == "" {
+				t.Name = fmt.Sprintf("%s#%d", filepath.Base(file), i+1)
+			}
+			tests = append(tests, t)
+		}
+	}
+	return tests, nil
+}
+
+// run evaluates the test input and returns a description of every
+// expectation that was not met
+func (t *policyTest) run() ([]string, error) {
+	switch t.Expect.Decision {
+	case decisionInject, decisionSkip, decisionDeny:
+	default:
+		return nil, fmt.Errorf("expect.decision must be %s, %s or %s, got %q", decisionInject, decisionSkip, decisionDeny, t.Expect.Decision)
+	}
+	cfg, err := t.config()
+	if err != nil {
+		return nil, err
+	}
+	obj, _, err := deserializer.Decode(t.Input, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decoding input: %v", err)
+	}
+	tmpl, err := podTemplateFor(obj)
+	if err != nil {
+		return nil, err
+	}
+	m := &mutator{config: cfg}
+	d, err := m.evaluate(context.TODO(), tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []string
+	check := func(field string, want, got interface{}) {
+		if diff := cmp.Diff(want, got); diff != "" {
+			failures = append(failures, fmt.Sprintf("%s mismatch (-want +got):\n%s", field, diff))
+		}
+	}
+
+	got := decisionSkip
+	if d.inject {
+		got = decisionInject
+	} else if d.deny {
+		got = decisionDeny
+	}
+	check("decision", t.Expect.Decision, got)
+	if t.Expect.Reason != "" {
+		check("reason", t.Expect.Reason, d.reason)
+	}
+	var targets []string
+	for _, target := range d.targets {
+		targets = append(targets, target.String())
+	}
+	if t.Expect.ChownTarget != "" {
+		var target string
+		if len(targets) > 0 {
+			target = targets[0]
+		}
+		check("chownTarget", t.Expect.ChownTarget, target)
+	}
+	if t.Expect.ChownTargets != nil {
+		check("chownTargets", t.Expect.ChownTargets, targets)
+	}
+	if t.Expect.InitContainer != nil {
+		var initContainer *corev1.Container
+		if len(d.initContainers) > 0 {
+			initContainer = &d.initContainers[0]
+		}
+		check("initContainer", t.Expect.InitContainer, initContainer)
+	}
+	if t.Expect.Annotations != nil {
+		check("annotations", t.Expect.Annotations, d.annotations)
+	}
+	return failures, nil
+}
+
+func (t *policyTest) config() (*MutationConfig, error) {
+	if len(t.Config) > 0 && string(t.Config) != "null" {
+		cfg, err := parseMutationConfig(t.Config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+		return cfg, nil
+	}
+	if t.ConfigFile == "" {
+		return &MutationConfig{}, nil
+	}
+	configFile := t.ConfigFile
+	if !filepath.IsAbs(configFile) {
+		configFile = filepath.Join(filepath.Dir(t.file), configFile)
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		return nil, err
+	}
+	return loadMutationConfig(configFile)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTestCommand(t *testing.T) {
+	t.Run("examples pass", func(t *testing.T) {
+		var out bytes.Buffer
+		err := runTestCommand([]string{"../examples/policy-tests"}, &out)
+		assert.NoError(t, err)
+		assert.Regexp(t, `^PASS: \d+ policy tests\n$`, out.String())
+	})
+
+	t.Run("failures are reported with a diff", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "policy-tests")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, "redis.yaml")
+		assert.NoError(t, ioutil.WriteFile(file, []byte(`name: wrong owner
+input:
+  apiVersion: v1
+  kind: Pod
+  metadata:
+    name: redis
+  spec:
+    containers:
+    - name: redis
+      volumeMounts:
+      - mountPath: /bitnami/redis/data
+        name: redis-data
+    securityContext:
+      fsGroup: 1001
+expect:
+  decision: inject
+  chownTarget: 1000:1000 /bitnami/redis/data
+`), 0644))
+
+		var out bytes.Buffer
+		err = runTestCommand([]string{file}, &out)
+		assert.EqualError(t, err, "1 of 1 policy tests failed")
+		assert.Contains(t, out.String(), "--- FAIL: wrong owner")
+		assert.Contains(t, out.String(), "chownTarget mismatch (-want +got)")
+		assert.Regexp(t, `-[^"\n]*"1000:1000 /bitnami/redis/data"`, out.String())
+		assert.Regexp(t, `\+[^"\n]*"1001:1001 /bitnami/redis/data"`, out.String())
+	})
+
+	t.Run("inline configs are validated", func(t *testing.T) {
+		test := &policyTest{Name: "invalid config", Config: []byte(`{"strategy": "chmod"}`), Expect: policyExpectation{Decision: decisionSkip}}
+		_, err := test.run()
+		assert.EqualError(t, err, `invalid config: unsupported strategy "chmod", expect chown, acl or verify`)
+	})
+
+	t.Run("invalid decision", func(t *testing.T) {
+		test := &policyTest{Name: "invalid", Expect: policyExpectation{Decision: "maybe"}}
+		_, err := test.run()
+		assert.Error(t, err)
+	})
+}
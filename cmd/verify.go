@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// verifySampleDepth is how deep the verify strategy checks below the
+	// volume roots unless the path options ask for less
+	verifySampleDepth = 2
+	// verifyReportedPaths bounds the offending paths in the termination
+	// message
+	verifyReportedPaths = 10
+)
+
+// verifyPaths narrows the path options down to the sample of the tree the
+// verify strategy checks
+func verifyPaths(paths *PathOptions) *PathOptions {
+	sample := PathOptions{}
+	if paths != nil {
+		sample = *paths
+	}
+	if sample.MaxDepth == nil || *sample.MaxDepth > verifySampleDepth {
+		depth := verifySampleDepth
+		sample.MaxDepth = &depth
+	}
+	return &sample
+}
+
+// verifyScript returns the shell commands failing with a termination message
+// naming the entries of the targets that the container user cannot write
+func verifyScript(targets []*chownTarget, paths *PathOptions) []string {
+	var finds []string
+	for _, t := range targets {
+		finds = append(finds, findCommand(t.mountPath, paths, "! -type l ! -writable -print")+";")
+	}
+	return []string{
+		fmt.Sprintf("offending=$( { %s } 2>&1 | head -n %d )", strings.Join(finds, " "), verifyReportedPaths),
+		`if [ -n "$offending" ]; then echo "not writable by $(id -u):$(id -g): $offending" | tee /dev/termination-log >&2; exit 1; fi`,
+		`echo "volumes writable by $(id -u):$(id -g)"`,
+	}
+}
+
+// verifyContainers renders a container per owner of the targets, running as
+// that owner so the checks see the access the app gets. The first container
+// keeps the template name, the others get a numbered suffix.
+func verifyContainers(template string, targets []*chownTarget, opts *fixOptions) ([]corev1.Container, error) {
+	var owners [][]*chownTarget
+	for _, t := range targets {
+		i := 0
+		for ; i < len(owners); i++ {
+			if owners[i][0].uid == t.uid && owners[i][0].gid == t.gid {
+				break
+			}
+		}
+		if i == len(owners) {
+			owners = append(owners, nil)
+		}
+		owners[i] = append(owners[i], t)
+	}
+
+	var containers []corev1.Container
+	for i, owned := range owners {
+		config, err := loadConfig(renderInitContainer(template, owned, opts))
+		if err != nil {
+			return nil, err
+		}
+		applyTargetMounts(config.InitContainers, owned)
+		for j := range config.InitContainers {
+			c := &config.InitContainers[j]
+			if i > 0 {
+				c.Name = fmt.Sprintf("%s-%d", c.Name, i+1)
+			}
+			if c.SecurityContext == nil {
+				c.SecurityContext = &corev1.SecurityContext{}
+			}
+			uid, gid := owned[0].uid, owned[0].gid
+			c.SecurityContext.RunAsUser = &uid
+			c.SecurityContext.RunAsGroup = &gid
+		}
+		containers = append(containers, config.InitContainers...)
+	}
+	return containers, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVerifyPaths(t *testing.T) {
+	one := 1
+	assert.Equal(t, verifySampleDepth, *verifyPaths(nil).MaxDepth)
+	assert.Equal(t, 1, *verifyPaths(&PathOptions{MaxDepth: &one}).MaxDepth)
+	sample := verifyPaths(&PathOptions{Exclude: []string{".snapshot"}})
+	assert.Equal(t, []string{".snapshot"}, sample.Exclude)
+	assert.Equal(t, verifySampleDepth, *sample.MaxDepth)
+}
+
+func TestVerifyScript(t *testing.T) {
+	targets := []*chownTarget{{uid: 1001, gid: 1001, mountPath: "/data"}, {uid: 1001, gid: 1001, mountPath: "/logs"}}
+	assert.Equal(t, []string{
+		`offending=$( { find /data -maxdepth 2 ! -type l ! -writable -print; find /logs -maxdepth 2 ! -type l ! -writable -print; } 2>&1 | head -n 10 )`,
+		`if [ -n "$offending" ]; then echo "not writable by $(id -u):$(id -g): $offending" | tee /dev/termination-log >&2; exit 1; fi`,
+		`echo "volumes writable by $(id -u):$(id -g)"`,
+	}, verifyScript(targets, verifyPaths(nil)))
+}
+
+func TestEvaluateVerifyStrategy(t *testing.T) {
+	tmpl := &podTemplate{
+		meta: &metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "restricted",
+			Annotations: map[string]string{admissionWebhookAnnotationStrategyKey: strategyVerify},
+		},
+		spec: &corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:            "app",
+					SecurityContext: &corev1.SecurityContext{RunAsUser: int64Ptr(1001), RunAsGroup: int64Ptr(1001)},
+					VolumeMounts:    []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				},
+				{
+					Name:            "exporter",
+					SecurityContext: &corev1.SecurityContext{RunAsUser: int64Ptr(65534), RunAsGroup: int64Ptr(65534)},
+					VolumeMounts:    []corev1.VolumeMount{{Name: "metrics", MountPath: "/metrics"}},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				{Name: "metrics", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "metrics"}}},
+			},
+		},
+	}
+
+	d, err := (&mutator{}).evaluate(context.TODO(), tmpl)
+	assert.NoError(t, err)
+	if assert.Len(t, d.initContainers, 2, "a container per owner") {
+		first, second := d.initContainers[0], d.initContainers[1]
+		assert.Equal(t, "volume-permissions", first.Name)
+		assert.Equal(t, int64(1001), *first.SecurityContext.RunAsUser)
+		assert.Equal(t, int64(1001), *first.SecurityContext.RunAsGroup)
+		assert.Contains(t, first.Command[2], "find /data -maxdepth 2 ! -type l ! -writable -print")
+		assert.NotContains(t, first.Command[2], "chown")
+		assert.Equal(t, "volume-permissions-2", second.Name)
+		assert.Equal(t, int64(65534), *second.SecurityContext.RunAsUser)
+		assert.Equal(t, "/metrics", second.VolumeMounts[0].MountPath)
+	}
+
+	m := &mutator{config: &MutationConfig{FixpermsImage: "docker.io/malston/volume-permissions-container-injector:v1"}}
+	d, err = m.evaluate(context.TODO(), tmpl)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-verify", "-max-depth=2", "-uid=1001", "-gid=1001", "-mode=", "/data"}, d.initContainers[0].Args)
+}
+
+func TestRunFixpermsCommandVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "db")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0600))
+
+	var out bytes.Buffer
+	assert.NoError(t, runFixpermsCommand([]string{"-verify", "-termination-message-path=", "-mode=g+rwX", dir}, &out))
+	assert.Contains(t, out.String(), "fixperms: verifying "+dir)
+	info, err := os.Stat(file)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "verify changes nothing")
+
+	assert.Error(t, runFixpermsCommand([]string{"-verify", "-termination-message-path=", filepath.Join(dir, "missing")}, &out))
+}
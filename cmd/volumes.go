@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	volumeTypePersistentVolumeClaim = "persistentVolumeClaim"
+	volumeTypeEphemeral             = "ephemeral"
+	volumeTypeNFS                   = "nfs"
+	volumeTypeHostPath              = "hostPath"
+)
+
+// volumeType names the source of a volume after its field in VolumeSource, it
+// is empty for sources the webhook does not distinguish
+func volumeType(v *corev1.Volume) string {
+	switch {
+	case v.PersistentVolumeClaim != nil:
+		return volumeTypePersistentVolumeClaim
+	case v.Ephemeral != nil:
+		return volumeTypeEphemeral
+	case v.NFS != nil:
+		return volumeTypeNFS
+	case v.HostPath != nil:
+		return volumeTypeHostPath
+	}
+	return ""
+}
+
+// findWritableVolumes returns the volumes backed by storage that outlives the
+// container: persistent volume claims, generic ephemeral volumes with a claim
+// template and inline volumes of the types opted in by the configuration
+func findWritableVolumes(volumes []corev1.Volume, cfg *MutationConfig) []corev1.Volume {
+	var writable []corev1.Volume
+	for i := range volumes {
+		v := &volumes[i]
+		switch t := volumeType(v); t {
+		case volumeTypePersistentVolumeClaim:
+			writable = append(writable, *v)
+		case volumeTypeEphemeral:
+			if v.Ephemeral.VolumeClaimTemplate != nil {
+				writable = append(writable, *v)
+			}
+		case volumeTypeNFS, volumeTypeHostPath:
+			if cfg.inlineVolumeType(t) {
+				writable = append(writable, *v)
+			}
+		}
+	}
+	return writable
+}
+
+// findEligibleVolumes returns the volumes whose mounts the injected container
+// may chown: the writable volumes and the volumes allowed by name. Denied
+// volumes, volumes the pod marks read-only and volumes consumed as raw block
+// devices are left out.
+func findEligibleVolumes(spec *corev1.PodSpec, volumes []corev1.Volume, cfg *MutationConfig) []corev1.Volume {
+	writable := volumeNames(findWritableVolumes(volumes, cfg))
+	blockDevices := blockDeviceNames(spec)
+	var eligible []corev1.Volume
+	for i := range volumes {
+		v := &volumes[i]
+		switch {
+		case cfg.volumeDenied(v.Name):
+			glog.Infof("Volume %s is denied by the configuration", v.Name)
+		case blockDevices[v.Name]:
+			glog.Infof("Volume %s is a raw block device", v.Name)
+		case readOnlyVolume(v):
+			glog.Infof("Volume %s is read-only", v.Name)
+		case writable(v.Name) || cfg.volumeAllowed(v.Name):
+			eligible = append(eligible, *v)
+		}
+	}
+	return eligible
+}
+
+// readOnlyVolume reports whether the volume source forces read-only mounts
+func readOnlyVolume(v *corev1.Volume) bool {
+	switch {
+	case v.PersistentVolumeClaim != nil:
+		return v.PersistentVolumeClaim.ReadOnly
+	case v.Ephemeral != nil:
+		return v.Ephemeral.ReadOnly
+	case v.NFS != nil:
+		return v.NFS.ReadOnly
+	}
+	return false
+}
+
+// blockDeviceNames returns the volumes the containers consume as raw block
+// devices through volumeDevices
+func blockDeviceNames(spec *corev1.PodSpec) map[string]bool {
+	names := map[string]bool{}
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for _, c := range containers {
+			for _, d := range c.VolumeDevices {
+				names[d.Name] = true
+			}
+		}
+	}
+	return names
+}
+
+// mountEligibility returns a func reporting whether the mounts of a volume
+// are eligible. Mounts of volumes the pod does not declare, as found in
+// partial manifests, are eligible unless denied by name or named like the
+// service account token volumes Kubernetes adds.
+func mountEligibility(volumes, eligible []corev1.Volume, cfg *MutationConfig) func(string) bool {
+	declared := volumeNames(volumes)
+	isEligible := volumeNames(eligible)
+	return func(name string) bool {
+		if !declared(name) {
+			return !cfg.volumeDenied(name) && !serviceAccountTokenVolume(name)
+		}
+		return isEligible(name)
+	}
+}
+
+// serviceAccountTokenVolume reports whether the name is one Kubernetes gives
+// the service account token volumes, legacy <account>-token-<suffix> secrets
+// or projected kube-api-access-<suffix> volumes
+func serviceAccountTokenVolume(name string) bool {
+	return strings.Contains(name, "-token-") || strings.HasPrefix(name, "kube-api-access-")
+}
+
+// volumeNames returns a func reporting whether a name is one of the volumes
+func volumeNames(volumes []corev1.Volume) func(string) bool {
+	names := map[string]bool{}
+	for _, v := range volumes {
+		names[v.Name] = true
+	}
+	return func(name string) bool {
+		return names[name]
+	}
+}
+
+// storageClassAllowed reports whether the storage class of the volume's claim
+// is one of the configured storage classes. Inline volumes and claims whose
+// storage class cannot be determined are allowed.
+func (m *mutator) storageClassAllowed(ctx context.Context, tmpl *podTemplate, v *corev1.Volume) (bool, string) {
+	if len(m.config.storageClassNames()) == 0 {
+		return true, ""
+	}
+
+	var class *string
+	switch volumeType(v) {
+	case volumeTypePersistentVolumeClaim:
+		class = m.claimStorageClass(ctx, tmpl, v.PersistentVolumeClaim.ClaimName)
+	case volumeTypeEphemeral:
+		class = v.Ephemeral.VolumeClaimTemplate.Spec.StorageClassName
+	default:
+		return true, ""
+	}
+	if class == nil {
+		glog.Infof("Storage class of volume %s in %s/%s is unknown, treating it as allowed", v.Name, tmpl.meta.Namespace, tmpl.meta.Name)
+		return true, ""
+	}
+
+	return m.config.storageClassListed(*class), *class
+}
+
+// claimStorageClass looks up the storage class of a claim in the StatefulSet
+// claim templates or, when a cluster is available, in the claim itself
+func (m *mutator) claimStorageClass(ctx context.Context, tmpl *podTemplate, claimName string) *string {
+	if claim := tmpl.claimTemplate(claimName); claim != nil {
+		return claim.Spec.StorageClassName
+	}
+	if m.clientset == nil {
+		return nil
+	}
+	claim, err := m.clientset.CoreV1().PersistentVolumeClaims(tmpl.meta.Namespace).Get(ctx, claimName, metav1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Could not look up claim %s/%s: %v", tmpl.meta.Namespace, claimName, err)
+		return nil
+	}
+	return claim.Spec.StorageClassName
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestFindWritableVolume(t *testing.T) {
+	configMap := corev1.Volume{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}}
+	nfs := corev1.Volume{Name: "shared", VolumeSource: corev1.VolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nas", Path: "/export/shared"}}}
+	hostPath := corev1.Volume{Name: "scratch", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/scratch"}}}
+	ephemeral := corev1.Volume{Name: "workspace", VolumeSource: corev1.VolumeSource{Ephemeral: &corev1.EphemeralVolumeSource{
+		VolumeClaimTemplate: &corev1.PersistentVolumeClaimTemplate{},
+	}}}
+	claim := corev1.Volume{Name: "cache", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "cache"}}}
+
+	tests := []struct {
+		name    string
+		volumes []corev1.Volume
+		cfg     *MutationConfig
+		want    []string
+	}{
+		{name: "no writable volume", volumes: []corev1.Volume{configMap}},
+		{name: "claim", volumes: []corev1.Volume{configMap, claim}, want: []string{"cache"}},
+		{name: "ephemeral claim template", volumes: []corev1.Volume{configMap, ephemeral, claim}, want: []string{"workspace", "cache"}},
+		{name: "inline volumes are not opted in", volumes: []corev1.Volume{nfs, hostPath}},
+		{name: "nfs opted in", volumes: []corev1.Volume{hostPath, nfs}, cfg: &MutationConfig{InlineVolumeTypes: []string{"nfs"}}, want: []string{"shared"}},
+		{name: "hostPath opted in", volumes: []corev1.Volume{hostPath, nfs}, cfg: &MutationConfig{InlineVolumeTypes: []string{"hostPath"}}, want: []string{"scratch"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range findWritableVolumes(tt.volumes, tt.cfg) {
+				got = append(got, v.Name)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFindEligibleVolumes(t *testing.T) {
+	volume := func(name string, source corev1.VolumeSource) corev1.Volume {
+		return corev1.Volume{Name: name, VolumeSource: source}
+	}
+	volumes := []corev1.Volume{
+		volume("kube-api-access-x7b2k", corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{}}),
+		volume("config", corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}),
+		volume("registry-credentials", corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{}}),
+		volume("podinfo", corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{}}),
+		volume("tmp", corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}),
+		volume("data", corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}),
+		volume("archive", corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "archive", ReadOnly: true}}),
+		volume("raw", corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "raw"}}),
+	}
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{{
+			Name:          "app",
+			VolumeDevices: []corev1.VolumeDevice{{Name: "raw", DevicePath: "/dev/xvda"}},
+		}},
+		Volumes: volumes,
+	}
+
+	tests := []struct {
+		name string
+		cfg  *MutationConfig
+		want []string
+	}{
+		{name: "by volume source", want: []string{"data"}},
+		{name: "allowed by name", cfg: &MutationConfig{AllowedVolumes: []string{"tmp", "archive"}}, want: []string{"tmp", "data"}},
+		{name: "denied by name", cfg: &MutationConfig{AllowedVolumes: []string{"tmp"}, DeniedVolumes: []string{"tmp", "da*"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range findEligibleVolumes(spec, volumes, tt.cfg) {
+				got = append(got, v.Name)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMountEligibility(t *testing.T) {
+	volumes := []corev1.Volume{
+		{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}},
+		{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+	}
+	cfg := &MutationConfig{DeniedVolumes: []string{"cache-*"}}
+	eligible := mountEligibility(volumes, findEligibleVolumes(&corev1.PodSpec{Volumes: volumes}, volumes, cfg), cfg)
+
+	assert.True(t, eligible("data"))
+	assert.False(t, eligible("config"))
+	assert.True(t, eligible("undeclared"), "mounts of undeclared volumes stay eligible")
+	assert.False(t, eligible("cache-0"))
+	assert.False(t, eligible("default-token-hw45h"), "undeclared service account tokens are not")
+	assert.False(t, eligible("kube-api-access-x2b9k"))
+}
+
+func TestFindMountOwnersSkipsReadOnlyMounts(t *testing.T) {
+	containers := []corev1.Container{{
+		Name: "app",
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "data", MountPath: "/data", ReadOnly: true},
+			{Name: "logs", MountPath: "/logs"},
+		},
+	}}
+	owners := findMountOwners(&corev1.PodSecurityContext{FSGroup: int64Ptr(1001)}, containers, func(string) bool { return true }, nil)
+	if assert.Len(t, owners, 1) {
+		assert.Equal(t, "logs", owners[0].mount.Name)
+	}
+}
+
+func TestParseMutationConfigInlineVolumeTypes(t *testing.T) {
+	cfg, err := parseMutationConfig([]byte("inlineVolumeTypes: [nfs, hostPath]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nfs", "hostPath"}, cfg.InlineVolumeTypes)
+
+	_, err = parseMutationConfig([]byte("inlineVolumeTypes: [emptyDir]\n"))
+	assert.Error(t, err)
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"k8s.io/client-go/kubernetes"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
@@ -19,6 +21,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	corelisters "k8s.io/client-go/listers/core/v1"
 )
 
 var (
@@ -34,13 +37,17 @@ var ignoredNamespaces = []string{
 
 const (
 	admissionWebhookAnnotationStatusKey = "volume-permissions-container-injector-webhook.malston.me/status"
-	configMapKey = "volumepermissions.yaml"
-	initContainerTemplate = `initContainers:
+	// admissionWebhookAnnotationConflictsKey reports how volume ownership
+	// conflicts between containers were resolved
+	admissionWebhookAnnotationConflictsKey = "volume-permissions-container-injector-webhook.malston.me/ownership-conflicts"
+	initContainerName                      = "volume-permissions"
+	configMapKey                           = "volumepermissions.yaml"
+	initContainerTemplate                  = `initContainers:
 - command:
   - /bin/bash
   - -ec
   - |-
-    chown -R replace-permission:replace-permission /replace-mountPath
+    replace-script
   image: docker.io/bitnami/bitnami-shell:10
   imagePullPolicy: Always
   name: volume-permissions
@@ -49,19 +56,40 @@ const (
   volumeMounts:
   - mountPath: /replace-mountPath
     name: replace-mountName
+`
+	// fixpermsContainerTemplate runs the fixperms subcommand of the webhook
+	// image, replace-image is the configured fixpermsImage
+	fixpermsContainerTemplate = `initContainers:
+- command:
+  - /usr/local/bin/volume-permissions-container-injector
+  - fixperms
+  args: replace-args
+  image: replace-image
+  imagePullPolicy: IfNotPresent
+  name: volume-permissions
+  securityContext:
+    runAsUser: 0
+  volumeMounts:
+  - mountPath: /replace-mountPath
+    name: replace-mountName
 `
 )
 
 type WebhookServer struct {
-	server        *http.Server
-	clientset *kubernetes.Clientset
+	server     *http.Server
+	clientset  kubernetes.Interface
+	namespaces corelisters.NamespaceLister
+	config     *MutationConfig
+	images     *imageInspector
 }
 
 type Parameters struct {
-	port           int    // webhook server port
-	certFile       string // path to the x509 certificate for https
-	keyFile        string // path to the x509 private key matching `CertFile`
+	port                 int    // webhook server port
+	certFile             string // path to the x509 certificate for https
+	keyFile              string // path to the x509 private key matching `CertFile`
 	initContainerCfgFile string // path to initcontainer injector configuration file
+	claimController      bool   // run the claim controller alongside the webhook server
+	podWatcher           bool   // report the outcome of the injected containers
 }
 
 type Config struct {
@@ -120,7 +148,7 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
 	return required
 }
 
-func addContainer(target, added []corev1.Container, basePath string) ([]patchOperation) {
+func addContainer(target, added []corev1.Container, basePath string) []patchOperation {
 	first := len(target) == 0
 	var value []corev1.Container
 	var patch []patchOperation
@@ -144,28 +172,36 @@ func addContainer(target, added []corev1.Container, basePath string) ([]patchOpe
 	return patch
 }
 
-func updateAnnotation(target map[string]string, added map[string]string) (patch []patchOperation) {
+func updateAnnotation(target map[string]string, added map[string]string, basePath string) (patch []patchOperation) {
+	if len(target) == 0 {
+		if len(added) == 0 {
+			return nil
+		}
+		return []patchOperation{{
+			Op:    "add",
+			Path:  basePath,
+			Value: added,
+		}}
+	}
 	for key, value := range added {
-		if target == nil || target[key] == "" {
-			target = map[string]string{}
-			patch = append(patch, patchOperation{
-				Op:   "add",
-				Path: "/metadata/annotations",
-				Value: map[string]string{
-					key: value,
-				},
-			})
-		} else {
-			patch = append(patch, patchOperation{
-				Op:    "replace",
-				Path:  "/metadata/annotations/" + key,
-				Value: value,
-			})
+		op := "add"
+		if _, ok := target[key]; ok {
+			op = "replace"
 		}
+		patch = append(patch, patchOperation{
+			Op:    op,
+			Path:  basePath + "/" + escapeJSONPointer(key),
+			Value: value,
+		})
 	}
 	return patch
 }
 
+// escapeJSONPointer escapes a single reference token as described in RFC 6901
+func escapeJSONPointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
 func (svr *WebhookServer) createUpdateConfigMap(ctx context.Context, name, namespace, content string) error {
 	glog.Infof("creating configmap with data: %s", content)
 	fqn := fmt.Sprintf("%s-%s", namespace, name)
@@ -189,121 +225,538 @@ func (svr *WebhookServer) createUpdateConfigMap(ctx context.Context, name, names
 }
 
 // create mutation patch for resources
-func createPatch(pod *corev1.Pod, initContainerConfig *Config, annotations map[string]string) ([]byte, error) {
+func createPatch(tmpl *podTemplate, d *decision) ([]byte, error) {
 	var patch []patchOperation
 
-	patch = append(patch, addContainer(pod.Spec.InitContainers, initContainerConfig.InitContainers, "/spec/initContainers")...)
-	patch = append(patch, updateAnnotation(pod.Annotations, annotations)...)
+	patch = append(patch, addContainer(tmpl.spec.InitContainers, d.initContainers, tmpl.basePath+"/spec/initContainers")...)
+	patch = append(patch, appendContainers(d.sidecars, tmpl.basePath+"/spec/containers")...)
+	patch = append(patch, addSupplementalGroups(tmpl.spec.SecurityContext, d.supplementalGroups, tmpl.basePath+"/spec/securityContext")...)
+	if tmpl.bareMeta && len(d.annotations) > 0 {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  tmpl.basePath + "/metadata",
+			Value: map[string]interface{}{"annotations": d.annotations},
+		})
+	} else {
+		patch = append(patch, updateAnnotation(tmpl.meta.Annotations, d.annotations, tmpl.basePath+"/metadata/annotations")...)
+	}
 
 	return json.Marshal(patch)
 }
 
-func replaceInitContainerStrings(podSecurityContext *corev1.PodSecurityContext, containers []corev1.Container, volumes []corev1.Volume) string {
-	volume := findVolumeWithPersistentVolumeClaim(volumes)
-	for _, c := range containers {
-		var container string
-		var permission int64
-		var mountPath, mountName string
-		for _, v := range c.VolumeMounts {
-			mountPath = v.MountPath
-			mountName = v.Name
-			if strings.Contains(mountPath, "serviceaccount") || strings.Contains(mountName, "default-token"){
-				continue
+func addSupplementalGroups(target *corev1.PodSecurityContext, added []int64, basePath string) (patch []patchOperation) {
+	if len(added) == 0 {
+		return nil
+	}
+	if target == nil {
+		return []patchOperation{{
+			Op:    "add",
+			Path:  basePath,
+			Value: corev1.PodSecurityContext{SupplementalGroups: added},
+		}}
+	}
+	if len(target.SupplementalGroups) == 0 {
+		return []patchOperation{{
+			Op:    "add",
+			Path:  basePath + "/supplementalGroups",
+			Value: added,
+		}}
+	}
+	for _, g := range added {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath + "/supplementalGroups/-",
+			Value: g,
+		})
+	}
+	return patch
+}
+
+func replaceInitContainerStrings(template string, podSecurityContext *corev1.PodSecurityContext, containers []corev1.Container, volumes []corev1.Volume) string {
+	spec := &corev1.PodSpec{Containers: containers, Volumes: volumes}
+	eligible := mountEligibility(volumes, findEligibleVolumes(spec, volumes, nil), nil)
+	targets, _, err := resolveOwnership(findMountOwners(podSecurityContext, containers, eligible, nil), conflictPolicyFirstWins, nil)
+	if err != nil || len(targets) == 0 {
+		return ""
+	}
+	return renderInitContainer(template, targets, &fixOptions{})
+}
+
+// renderInitContainer replaces the placeholders of the init container
+// template. replace-script expands to the commands fixing every target, the
+// other placeholders refer to the first target.
+func renderInitContainer(template string, targets []*chownTarget, opts *fixOptions) string {
+	first := targets[0]
+	container := replaceIndented(template, "replace-script", renderScript(targets, opts))
+	container = strings.Replace(container, "replace-args", renderFixpermsArgs(targets, opts), -1)
+	container = strings.Replace(container, "replace-permission", strconv.FormatInt(first.gid, 10), -1)
+	container = strings.Replace(container, "replace-user", strconv.FormatInt(first.uid, 10), -1)
+	container = strings.Replace(container, "replace-group", strconv.FormatInt(first.gid, 10), -1)
+	container = strings.Replace(container, "/replace-mountPath", first.mountPath, -1)
+	return strings.Replace(container, "replace-mountName", first.mountName, -1)
+}
+
+// fixOptions are the per pod settings of the commands fixing the targets
+type fixOptions struct {
+	strategy string
+	paths    *PathOptions
+	// relabel is nil unless the targets are relabeled for SELinux
+	relabel *selinuxRelabel
+	// leaseDuration is passed to fixperms for coordinated targets
+	leaseDuration time.Duration
+}
+
+// renderScript returns the shell commands fixing the targets with the
+// strategy of the options
+func renderScript(targets []*chownTarget, opts *fixOptions) []string {
+	if opts.strategy == strategyVerify {
+		return verifyScript(targets, opts.paths)
+	}
+	var script []string
+	if opts.strategy == strategyACL {
+		script = append(script, aclPreflight)
+	}
+	for _, t := range targets {
+		switch opts.strategy {
+		case strategyACL:
+			script = append(script, aclCommands(t, opts.paths)...)
+		default:
+			script = append(script, chownCommands(t, opts.paths)...)
+		}
+		if opts.relabel == nil {
+			continue
+		}
+		if opts.paths.empty() {
+			script = append(script, fmt.Sprintf("chcon -R %s %s", opts.relabel.chconArgs(), shellWord(t.mountPath)))
+		} else {
+			script = append(script, findCommand(t.mountPath, opts.paths, fmt.Sprintf("-exec chcon -h %s {} +", opts.relabel.chconArgs())))
+		}
+	}
+	return script
+}
+
+// renderFixpermsArgs returns the arguments of the fixperms subcommand fixing
+// the targets as a YAML flow sequence
+func renderFixpermsArgs(targets []*chownTarget, opts *fixOptions) string {
+	var args []string
+	if opts.strategy == strategyVerify {
+		args = append(args, "-verify")
+	}
+	if paths := opts.paths; !paths.empty() {
+		for _, p := range paths.Include {
+			args = append(args, "-include="+p)
+		}
+		for _, p := range paths.Exclude {
+			args = append(args, "-exclude="+p)
+		}
+		if paths.MaxDepth != nil {
+			args = append(args, "-max-depth="+strconv.Itoa(*paths.MaxDepth))
+		}
+		if paths.StopAtMountPoints {
+			args = append(args, "-xdev")
+		}
+	}
+	coordinated, recorded := false, false
+	for _, t := range targets {
+		coordinated = coordinated || t.lease != ""
+		recorded = recorded || t.claim != ""
+	}
+	if coordinated {
+		args = append(args, "-lease-duration="+opts.leaseDuration.String())
+	}
+	for _, t := range targets {
+		args = append(args, fmt.Sprintf("-uid=%d", t.uid), fmt.Sprintf("-gid=%d", t.gid), "-mode="+recordMode(t))
+		if coordinated {
+			args = append(args, "-lease="+t.lease)
+		}
+		if recorded {
+			args = append(args, "-claim="+t.claim)
+		}
+		args = append(args, t.mountPath)
+	}
+	out, _ := json.Marshal(args)
+	return string(out)
+}
+
+// replaceIndented replaces the placeholder with the lines, indenting every
+// line after the first like the line holding the placeholder so the result
+// stays inside a YAML block scalar
+func replaceIndented(template, placeholder string, lines []string) string {
+	var out []string
+	for _, line := range strings.Split(template, "\n") {
+		if i := strings.Index(line, placeholder); i >= 0 {
+			indent := line[:len(line)-len(strings.TrimLeft(line, " "))]
+			line = line[:i] + strings.Join(lines, "\n"+indent) + line[i+len(placeholder):]
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+// applyTargetMounts adds the mounts of every target to the injected containers
+// that mount the first target. The mounts use the subPath of the app mounts so
+// only the portion of the volume the app uses is changed.
+func applyTargetMounts(containers []corev1.Container, targets []*chownTarget) {
+	first := targets[0]
+	for i := range containers {
+		c := &containers[i]
+		found := false
+		for j := range c.VolumeMounts {
+			m := &c.VolumeMounts[j]
+			if m.Name == first.mountName && m.MountPath == first.mountPath {
+				m.SubPath = first.subPath
+				m.SubPathExpr = first.subPathExpr
+				found = true
 			}
-			if volume == nil || volume.Name == v.Name {
-				if c.SecurityContext != nil && c.SecurityContext.RunAsGroup != nil {
-					permission = *c.SecurityContext.RunAsGroup
-					container = strings.Replace(initContainerTemplate, "replace-permission", strconv.FormatInt(permission, 10), -1)
-				}
-				if container == "" {
-					container = strings.Replace(initContainerTemplate, "/replace-mountPath", mountPath, -1)
-				} else {
-					container = strings.Replace(container, "/replace-mountPath", mountPath, -1)
+		}
+		if !found {
+			continue
+		}
+		for _, t := range targets {
+			if t != first {
+				c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+					Name:        t.mountName,
+					MountPath:   t.mountPath,
+					SubPath:     t.subPath,
+					SubPathExpr: t.subPathExpr,
+				})
+			}
+			for _, e := range t.env {
+				if !hasEnv(c.Env, e.Name) {
+					c.Env = append(c.Env, e)
 				}
-				container = strings.Replace(container, "replace-mountName", mountName, -1)
 			}
 		}
-		if podSecurityContext != nil && podSecurityContext.FSGroup != nil {
-			permission = *podSecurityContext.FSGroup
-			if container == "" {
-				container = strings.Replace(initContainerTemplate, "replace-permission", strconv.FormatInt(permission, 10), -1)
-			} else {
-				container = strings.Replace(container, "replace-permission", strconv.FormatInt(permission, 10), -1)
+	}
+}
+
+func hasEnv(env []corev1.EnvVar, name string) bool {
+	for _, e := range env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// decision records whether a pod template is mutated and what gets injected
+type decision struct {
+	inject bool
+	// deny rejects the object, reason tells why
+	deny           bool
+	reason         string
+	targets        []*chownTarget
+	initContainers []corev1.Container
+	// sidecars are appended to the pod containers
+	sidecars    []corev1.Container
+	annotations map[string]string
+	// supplementalGroups are added to the pod security context
+	supplementalGroups []int64
+	warnings           []string
+}
+
+// mutator evaluates pod templates against the mutation configuration
+type mutator struct {
+	config *MutationConfig
+	// clientset looks up objects related to the pod template, it is nil when
+	// manifests are evaluated without a cluster
+	clientset kubernetes.Interface
+	// namespaces reads the namespaces of the pod templates from the informer
+	// cache, it is nil when manifests are evaluated without a cluster
+	namespaces corelisters.NamespaceLister
+	// images looks up the users of images, it is nil when image inspection
+	// is off
+	images *imageInspector
+	// dryRun is set for dry run requests, which must have no side effects
+	dryRun bool
+}
+
+// evaluate decides whether and how the pod template is mutated
+func (m *mutator) evaluate(ctx context.Context, tmpl *podTemplate) (*decision, error) {
+	// determine whether to perform mutation
+	if !mutationRequired(ignoredNamespaces, tmpl.meta) {
+		return &decision{reason: "policy check"}, nil
+	}
+	// the controller template is mutated already, mutating the owned
+	// workload again makes it differ from the controller template
+	if tmpl.controller != nil {
+		return &decision{reason: fmt.Sprintf("owned by %s %s", tmpl.controller.Kind, tmpl.controller.Name)}, nil
+	}
+	if hasInitContainer(tmpl.spec.InitContainers, initContainerName) {
+		return &decision{reason: initContainerName + " init container already present"}, nil
+	}
+
+	defaults, err := m.namespaceDefaults(tmpl)
+	if err != nil {
+		return &decision{deny: true, reason: err.Error()}, nil
+	}
+	if cfg := m.config.withNamespaceDefaults(defaults); cfg != m.config {
+		withDefaults := *m
+		withDefaults.config = cfg
+		m = &withDefaults
+	}
+
+	// mounts are eligible by the source of their volume, the storage class of
+	// claims narrows them down
+	volumes := tmpl.volumes()
+	var allowed []corev1.Volume
+	var reasons []string
+	for _, v := range findEligibleVolumes(tmpl.spec, volumes, m.config) {
+		if ok, class := m.storageClassAllowed(ctx, tmpl, &v); ok {
+			allowed = append(allowed, v)
+		} else {
+			reasons = append(reasons, fmt.Sprintf("volume %s having storage class %q", v.Name, class))
+		}
+	}
+	if len(allowed) == 0 && len(reasons) > 0 {
+		return &decision{reason: strings.Join(reasons, ", ")}, nil
+	}
+	eligible := mountEligibility(volumes, allowed, m.config)
+
+	// the users in the image configs come after the presets
+	presets := m.config.ownershipPresets()
+	containers := m.config.ownershipContainers(tmpl.spec.Containers)
+	initContainers := m.config.ownershipContainers(tmpl.spec.InitContainers)
+	imagePresets, imageWarnings := m.imagePresets(ctx, tmpl, append(append([]corev1.Container{}, containers...), initContainers...), eligible, presets)
+	if len(imagePresets) > 0 {
+		presets = append(append([]OwnershipPreset{}, presets...), imagePresets...)
+	}
+	owners := findMountOwners(tmpl.spec.SecurityContext, containers, eligible, presets)
+	if len(owners) == 0 {
+		glog.Info("No pod containers have security context or volume mount that requires mutation")
+		owners = findMountOwners(tmpl.spec.SecurityContext, initContainers, eligible, presets)
+		if len(owners) == 0 {
+			return &decision{reason: "pod not containing a securityContext or volumes", warnings: imageWarnings}, nil
+		}
+	}
+
+	paths, err := pathOptionsFor(m.config, tmpl.meta.Annotations)
+	if err != nil {
+		return &decision{deny: true, reason: err.Error()}, nil
+	}
+	relabel, err := selinuxRelabelFor(m.config, tmpl.meta.Annotations, tmpl.spec.SecurityContext)
+	if err != nil {
+		return &decision{deny: true, reason: err.Error()}, nil
+	}
+	strategy, err := strategyFor(m.config, tmpl.meta.Annotations)
+	if err != nil {
+		return &decision{deny: true, reason: err.Error()}, nil
+	}
+	coordinated, err := coordinationFor(m.config, tmpl.meta.Annotations)
+	if err != nil {
+		return &decision{deny: true, reason: err.Error()}, nil
+	}
+	enforcement, err := enforcementFor(m.config, tmpl.meta.Annotations)
+	if err != nil {
+		return &decision{deny: true, reason: err.Error()}, nil
+	}
+	var enforcementWarning string
+	if enforcement > 0 && runsToCompletion(tmpl) {
+		enforcement = 0
+		enforcementWarning = "the enforcer sidecar never exits and would keep pods running to completion from completing; not enforcing"
+	}
+
+	sharedGroup, supplementalGroups := m.config.sharedGroup(tmpl.spec.SecurityContext)
+	targets, conflicts, err := resolveOwnership(owners, m.config.conflictPolicy(), sharedGroup)
+	if err != nil {
+		return &decision{deny: true, reason: err.Error()}, nil
+	}
+	level, nonRoot := defaults.podSecurityLevel(), requiresNonRoot(tmpl.spec.SecurityContext)
+	requested := fixOptions{strategy: strategy, paths: paths, relabel: relabel, leaseDuration: m.config.leaseDuration()}
+	opts, strategyWarnings, err := m.config.selectStrategy(level, nonRoot, requested, targets)
+	if err != nil {
+		return &decision{deny: true, reason: err.Error()}, nil
+	}
+	if opts.strategy != strategy {
+		glog.Infof("Verifying the volumes of %s/%s instead of fixing them, under Pod Security %q and runAsNonRoot %t", tmpl.meta.Namespace, tmpl.meta.Name, level, nonRoot)
+	}
+	strategy = opts.strategy
+	hardening := hardeningFor(level, m.config.hardening())
+	d := &decision{
+		inject:      true,
+		targets:     targets,
+		annotations: map[string]string{admissionWebhookAnnotationStatusKey: "injected"},
+		warnings:    imageWarnings,
+	}
+	d.warnings = append(d.warnings, strategyWarnings...)
+	if enforcementWarning != "" {
+		d.warnings = append(d.warnings, enforcementWarning)
+	}
+	if presets := appliedPresets(owners); presets != "" {
+		glog.Infof("Ownership presets applied to %s/%s: %s", tmpl.meta.Namespace, tmpl.meta.Name, presets)
+		d.annotations[admissionWebhookAnnotationPresetsKey] = presets
+	}
+	if len(conflicts) > 0 {
+		glog.Infof("Ownership conflicts in %s/%s: %s", tmpl.meta.Namespace, tmpl.meta.Name, strings.Join(conflicts, "; "))
+		d.annotations[admissionWebhookAnnotationConflictsKey] = strings.Join(conflicts, "; ")
+		d.warnings = append(d.warnings, conflicts...)
+		for _, t := range targets {
+			if t.groupWritable {
+				d.supplementalGroups = supplementalGroups
+				break
 			}
 		}
-		if container == "" || strings.Contains(container, "replace-") {
-			continue
+	}
+
+	template := m.config.template(opts)
+	if strategy == strategyVerify {
+		if enforcement > 0 {
+			d.warnings = append(d.warnings, "the verify strategy changes nothing, not enforcing")
+		}
+		if d.initContainers, err = verifyContainers(template, targets, opts); err != nil {
+			return nil, err
+		}
+		applyTerminationMessagePolicy(d.initContainers)
+		hardening.apply(d.initContainers, targets, opts)
+		if level == podSecurityRestricted {
+			applyRestricted(d.initContainers)
+		}
+		d.warnings = append(d.warnings, podSecurityWarnings(level, tmpl.meta.Namespace, d.initContainers, tmpl.spec.SecurityContext)...)
+		return d, nil
+	}
+	if coordinated {
+		coordinate(tmpl, d, template)
+	}
+	// the enforcer sidecar fixes the volumes whatever their claims record
+	if m.config.recordFixes() && enforcement == 0 {
+		if reason := m.recordFixes(ctx, tmpl, d, template, opts.paths); reason != "" {
+			return &decision{reason: reason, warnings: d.warnings}, nil
+		}
+		targets = d.targets
+	}
+	m.grantFixpermsAccess(ctx, tmpl, d)
+	initContainer := renderInitContainer(template, targets, opts)
+	initContainerConfig, err := loadConfig(initContainer)
+	if err != nil {
+		glog.Errorf("Failed to load configuration: %v", err)
+		return nil, err
+	}
+	if strategy == strategyACL {
+		if err := m.config.checkACLImages(initContainerConfig.InitContainers); err != nil {
+			return &decision{deny: true, reason: err.Error()}, nil
+		}
+	}
+	applyTargetMounts(initContainerConfig.InitContainers, targets)
+	for _, t := range targets {
+		if t.lease != "" || t.claim != "" {
+			applyPodEnv(initContainerConfig.InitContainers)
+			break
+		}
+	}
+	if opts.relabel != nil {
+		opts.relabel.applyProcessContext(initContainerConfig.InitContainers)
+	}
+	glog.Infof("initContainer: %s", initContainer)
+	applyTerminationMessagePolicy(initContainerConfig.InitContainers)
+	hardening.apply(initContainerConfig.InitContainers, targets, opts)
+	if nonRoot {
+		overrideNonRoot(initContainerConfig.InitContainers)
+		d.warnings = append(d.warnings, fmt.Sprintf("the pod requires non-root containers (runAsNonRoot), the %s init container overrides it to run as root", initContainerName))
+	}
+	d.initContainers = initContainerConfig.InitContainers
+	d.warnings = append(d.warnings, podSecurityWarnings(level, tmpl.meta.Namespace, d.initContainers, tmpl.spec.SecurityContext)...)
+	if enforcement > 0 {
+		if !strings.Contains(template, "replace-args") {
+			d.warnings = append(d.warnings, "the enforcer sidecar needs the fixperms container, configure a fixpermsImage; not enforcing")
+			return d, nil
+		}
+		sidecar, err := enforcerContainer(&d.initContainers[0], targets, opts, enforcement)
+		if err != nil {
+			return nil, err
 		}
-		return container
+		d.sidecars = append(d.sidecars, sidecar)
+		d.warnings = append(d.warnings, podSecurityWarnings(level, tmpl.meta.Namespace, d.sidecars, tmpl.spec.SecurityContext)...)
 	}
+	return d, nil
+}
 
-	return ""
+// mutatePodTemplate computes the patch for a pod template, or returns a nil
+// patch when the template does not need to be mutated. A denied template is
+// reported as an error.
+func (m *mutator) mutatePodTemplate(ctx context.Context, tmpl *podTemplate) ([]byte, *decision, error) {
+	d, err := m.evaluate(ctx, tmpl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.deny {
+		glog.Infof("Denying %s/%s due to %s", tmpl.meta.Namespace, tmpl.meta.Name, d.reason)
+		return nil, d, errors.New(d.reason)
+	}
+	if !d.inject {
+		glog.Infof("Skipping mutation for %s/%s due to %s", tmpl.meta.Namespace, tmpl.meta.Name, d.reason)
+		return nil, d, nil
+	}
+	patch, err := createPatch(tmpl, d)
+	return patch, d, err
 }
 
-func findVolumeWithPersistentVolumeClaim(volumes []corev1.Volume) *corev1.Volume {
-	for _, v := range volumes {
-		if v.VolumeSource.PersistentVolumeClaim != nil {
-			return &v
+func hasInitContainer(containers []corev1.Container, name string) bool {
+	for _, c := range containers {
+		if c.Name == name {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
 // main mutation process
 func (svr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	req := ar.Request
-	var pod corev1.Pod
-	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-		glog.Errorf("Could not unmarshal raw object: %v", err)
+	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
+		req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
+
+	// the webhook handles pods and the workloads creating them, any other
+	// kind is rejected so a misconfigured webhook is noticed
+	obj, err := decodeObject(req.Kind, req.Object.Raw)
+	if err != nil {
+		glog.Errorf("Rejecting %s/%s: %v", req.Namespace, req.Name, err)
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
-				Message: err.Error(),
+				Message: fmt.Sprintf("volume permissions webhook cannot mutate the object: %v", err),
 			},
 		}
 	}
-
-	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
-
-	// determine whether to perform mutation
-	if !mutationRequired(ignoredNamespaces, &pod.ObjectMeta) {
-		glog.Infof("Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
+	tmpl, err := podTemplateFor(obj)
+	if err != nil {
+		glog.Errorf("Rejecting %s/%s: %v", req.Namespace, req.Name, err)
 		return &v1beta1.AdmissionResponse{
-			Allowed: true,
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("volume permissions webhook cannot mutate the object: %v", err),
+			},
 		}
 	}
-
-	initContainer := replaceInitContainerStrings(pod.Spec.SecurityContext, pod.Spec.Containers, pod.Spec.Volumes)
-	if initContainer == "" {
-		glog.Info("No pod containers have security context or volume mount that requires mutation")
-		initContainer = replaceInitContainerStrings(pod.Spec.SecurityContext, pod.Spec.InitContainers, pod.Spec.Volumes)
-		if initContainer == "" {
-			glog.Infof("Skipping mutation for %s/%s due to pod not containing a securityContext or volumes", pod.Namespace, pod.Name)
-			return &v1beta1.AdmissionResponse{
-				Allowed: true,
-			}
-		}
+	// pods created by controllers carry no namespace in the admitted object
+	if tmpl.meta.Namespace == "" {
+		tmpl.meta.Namespace = req.Namespace
 	}
 
-	initContainerConfig, err := loadConfig(initContainer)
-	if err != nil {
-		glog.Errorf("Failed to load configuration: %v", err)
+	m := &mutator{config: svr.config, clientset: svr.clientset, namespaces: svr.namespaces, images: svr.images, dryRun: req.DryRun != nil && *req.DryRun}
+	patchBytes, d, err := m.mutatePodTemplate(context.TODO(), tmpl)
+	// the warnings of the decision reach the user whatever the outcome
+	var warnings []string
+	if d != nil {
+		warnings = d.warnings
 	}
-	glog.Infof("initContainer: %s", initContainer)
-	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
-	patchBytes, err := createPatch(&pod, initContainerConfig, annotations)
 	if err != nil {
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
+			Warnings: warnings,
+		}
+	}
+	if patchBytes == nil {
+		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: warnings,
 		}
 	}
 
 	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
 	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
+		Allowed:  true,
+		Warnings: warnings,
+		Patch:    patchBytes,
 		PatchType: func() *v1beta1.PatchType {
 			pt := v1beta1.PatchTypeJSONPatch
 			return &pt
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"testing"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 var initContainers = `initContainers:
@@ -25,7 +34,7 @@ var initContainers = `initContainers:
 `
 
 var posCases = []struct {
-	pod *corev1.Pod
+	pod            *corev1.Pod
 	initContainers bool
 }{
 	{
@@ -70,8 +79,7 @@ var posCases = []struct {
 			ObjectMeta: metav1.ObjectMeta{Name: "positive-testcase3"},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
-					{
-					},
+					{},
 					{
 						VolumeMounts: []corev1.VolumeMount{
 							{
@@ -91,8 +99,7 @@ var posCases = []struct {
 			ObjectMeta: metav1.ObjectMeta{Name: "positive-testcase4"},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
-					{
-					},
+					{},
 					{
 						VolumeMounts: []corev1.VolumeMount{
 							{
@@ -136,8 +143,7 @@ var posCases = []struct {
 			ObjectMeta: metav1.ObjectMeta{Name: "positive-testcase5"},
 			Spec: corev1.PodSpec{
 				InitContainers: []corev1.Container{
-					{
-					},
+					{},
 					{
 						VolumeMounts: []corev1.VolumeMount{
 							{
@@ -183,8 +189,7 @@ var negCases = []struct {
 			ObjectMeta: metav1.ObjectMeta{Name: "negative-testcase1"},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
-					{
-					},
+					{},
 				},
 				SecurityContext: &corev1.PodSecurityContext{
 					FSGroup: func(i int64) *int64 { return &i }(1001),
@@ -277,6 +282,60 @@ var negCases = []struct {
 			Spec:       corev1.PodSpec{},
 		},
 	},
+	{
+		pod: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "negative-testcase8"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						VolumeMounts: []corev1.VolumeMount{
+							{
+								Name: "default-token-hw45h", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+							},
+						},
+					},
+				},
+				SecurityContext: &corev1.PodSecurityContext{
+					FSGroup: func(i int64) *int64 { return &i }(1001),
+				},
+				Volumes: []corev1.Volume{
+					{
+						Name: "default-token-hw45h",
+						VolumeSource: corev1.VolumeSource{
+							Secret: &corev1.SecretVolumeSource{SecretName: "default-token-hw45h"},
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		pod: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "negative-testcase9"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						VolumeMounts: []corev1.VolumeMount{
+							{
+								Name: "tls", MountPath: "/etc/tls",
+							},
+						},
+					},
+				},
+				SecurityContext: &corev1.PodSecurityContext{
+					FSGroup: func(i int64) *int64 { return &i }(1001),
+				},
+				Volumes: []corev1.Volume{
+					{
+						Name: "tls",
+						VolumeSource: corev1.VolumeSource{
+							Secret: &corev1.SecretVolumeSource{SecretName: "redis-tls"},
+						},
+					},
+				},
+			},
+		},
+	},
 }
 
 func TestReplaceInitContainerStrings(t *testing.T) {
@@ -284,13 +343,13 @@ func TestReplaceInitContainerStrings(t *testing.T) {
 		want := initContainers
 		for _, c := range posCases {
 			if len(c.pod.Spec.Containers) > 0 {
-				got := replaceInitContainerStrings(c.pod.Spec.SecurityContext, c.pod.Spec.Containers, c.pod.Spec.Volumes)
+				got := replaceInitContainerStrings(initContainerTemplate, c.pod.Spec.SecurityContext, c.pod.Spec.Containers, c.pod.Spec.Volumes)
 				if diff := cmp.Diff(want, got); diff != "" {
 					t.Errorf("replaceInitContainerStrings(%s) got %s want %s", c.pod.Name, got, want)
 				}
 			}
 			if len(c.pod.Spec.InitContainers) > 0 {
-				got := replaceInitContainerStrings(c.pod.Spec.SecurityContext, c.pod.Spec.InitContainers, c.pod.Spec.Volumes)
+				got := replaceInitContainerStrings(initContainerTemplate, c.pod.Spec.SecurityContext, c.pod.Spec.InitContainers, c.pod.Spec.Volumes)
 				if diff := cmp.Diff(want, got); diff != "" {
 					t.Errorf("replaceInitContainerStrings(%s) got %s want %s", c.pod.Name, got, want)
 				}
@@ -301,7 +360,7 @@ func TestReplaceInitContainerStrings(t *testing.T) {
 	t.Run("negative cases", func(t *testing.T) {
 		for _, c := range negCases {
 			want := ""
-			got := replaceInitContainerStrings(c.pod.Spec.SecurityContext, c.pod.Spec.Containers, c.pod.Spec.Volumes)
+			got := replaceInitContainerStrings(initContainerTemplate, c.pod.Spec.SecurityContext, c.pod.Spec.Containers, c.pod.Spec.Volumes)
 			if diff := cmp.Diff("", got); diff != "" {
 				t.Errorf("replaceInitContainerStrings(%s) got %s want %s", c.pod.Name, got, want)
 			}
@@ -313,8 +372,8 @@ func TestAddContainer(t *testing.T) {
 	t.Run("positive cases", func(t *testing.T) {
 		var want []patchOperation
 		want = append(want, patchOperation{
-			Op:    "add",
-			Path:  "/spec/initContainers",
+			Op:   "add",
+			Path: "/spec/initContainers",
 		})
 		for _, c := range posCases {
 			initContainerConfig, err := loadConfig(initContainers)
@@ -353,3 +412,276 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("loadConfig(%s) got %v want %v", initContainers, got, want)
 	}
 }
+
+func TestMutate(t *testing.T) {
+	review := func(kind metav1.GroupVersionKind, object string) *v1beta1.AdmissionReview {
+		return &v1beta1.AdmissionReview{
+			Request: &v1beta1.AdmissionRequest{
+				Kind:      kind,
+				Namespace: "sentry-pro",
+				Object:    runtime.RawExtension{Raw: []byte(object)},
+			},
+		}
+	}
+	svr := &WebhookServer{}
+
+	t.Run("deployment template", func(t *testing.T) {
+		resp := svr.mutate(review(metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, `{
+			"metadata": {"name": "redis"},
+			"spec": {"template": {
+				"metadata": {"annotations": {"app": "redis"}},
+				"spec": {
+					"securityContext": {"fsGroup": 1001},
+					"containers": [{"name": "redis", "volumeMounts": [{"name": "redis-data", "mountPath": "/bitnami/redis/data"}]}]
+				}
+			}}
+		}`))
+		assert.True(t, resp.Allowed)
+		var patch []patchOperation
+		assert.NoError(t, json.Unmarshal(resp.Patch, &patch))
+		if assert.Len(t, patch, 2) {
+			assert.Equal(t, "/spec/template/spec/initContainers", patch[0].Path)
+			assert.Equal(t, "/spec/template/metadata/annotations/volume-permissions-container-injector-webhook.malston.me~1status", patch[1].Path)
+		}
+	})
+
+	t.Run("cronjob template", func(t *testing.T) {
+		resp := svr.mutate(review(metav1.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: "CronJob"}, `{
+			"metadata": {"name": "backup"},
+			"spec": {"jobTemplate": {"spec": {"template": {"spec": {
+				"securityContext": {"fsGroup": 1001},
+				"containers": [{"name": "backup", "volumeMounts": [{"name": "data", "mountPath": "/data"}]}]
+			}}}}}
+		}`))
+		assert.True(t, resp.Allowed)
+		assert.Contains(t, string(resp.Patch), `"path":"/spec/jobTemplate/spec/template/spec/initContainers"`)
+	})
+
+	t.Run("templates without metadata", func(t *testing.T) {
+		for _, tt := range []struct {
+			kind     metav1.GroupVersionKind
+			object   string
+			template func(map[string]interface{}) interface{}
+		}{
+			{
+				kind: metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+				object: `{"metadata": {"name": "backup"}, "spec": {"template": {"spec": {
+					"securityContext": {"fsGroup": 1001},
+					"containers": [{"name": "backup", "volumeMounts": [{"name": "data", "mountPath": "/data"}]}]
+				}}}}`,
+				template: func(o map[string]interface{}) interface{} {
+					return o["spec"].(map[string]interface{})["template"]
+				},
+			},
+			{
+				kind: metav1.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: "CronJob"},
+				object: `{"metadata": {"name": "backup"}, "spec": {"jobTemplate": {"spec": {"template": {"spec": {
+					"securityContext": {"fsGroup": 1001},
+					"containers": [{"name": "backup", "volumeMounts": [{"name": "data", "mountPath": "/data"}]}]
+				}}}}}}`,
+				template: func(o map[string]interface{}) interface{} {
+					job := o["spec"].(map[string]interface{})["jobTemplate"].(map[string]interface{})
+					return job["spec"].(map[string]interface{})["template"]
+				},
+			},
+		} {
+			resp := svr.mutate(review(tt.kind, tt.object))
+			assert.True(t, resp.Allowed, tt.kind.Kind)
+			patch, err := jsonpatch.DecodePatch(resp.Patch)
+			assert.NoError(t, err, tt.kind.Kind)
+			mutated, err := patch.Apply([]byte(tt.object))
+			if !assert.NoError(t, err, tt.kind.Kind) {
+				continue
+			}
+			var o map[string]interface{}
+			assert.NoError(t, json.Unmarshal(mutated, &o))
+			template := tt.template(o).(map[string]interface{})
+			annotations := template["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+			assert.Equal(t, "injected", annotations[admissionWebhookAnnotationStatusKey], tt.kind.Kind)
+		}
+	})
+
+	t.Run("ignored namespace from request", func(t *testing.T) {
+		r := review(metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, `{
+			"spec": {
+				"securityContext": {"fsGroup": 1001},
+				"containers": [{"name": "redis", "volumeMounts": [{"name": "redis-data", "mountPath": "/bitnami/redis/data"}]}]
+			}
+		}`)
+		r.Request.Namespace = metav1.NamespaceSystem
+		resp := svr.mutate(r)
+		assert.True(t, resp.Allowed)
+		assert.Nil(t, resp.Patch)
+	})
+
+	t.Run("unsupported kind", func(t *testing.T) {
+		resp := svr.mutate(review(metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, `{"metadata": {"name": "sentry"}}`))
+		assert.False(t, resp.Allowed)
+		assert.Contains(t, resp.Result.Message, "unsupported kind")
+	})
+
+	t.Run("unregistered version", func(t *testing.T) {
+		resp := svr.mutate(review(metav1.GroupVersionKind{Group: "batch", Version: "v2", Kind: "CronJob"}, `{"metadata": {"name": "backup"}}`))
+		assert.False(t, resp.Allowed)
+		assert.Contains(t, resp.Result.Message, "unsupported kind")
+	})
+
+	t.Run("replicaset owned by a deployment", func(t *testing.T) {
+		resp := svr.mutate(review(metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"}, `{
+			"metadata": {"name": "redis-5d4f8", "ownerReferences": [{"apiVersion": "apps/v1", "kind": "Deployment", "name": "redis", "uid": "1", "controller": true}]},
+			"spec": {"template": {"spec": {
+				"securityContext": {"fsGroup": 1001},
+				"containers": [{"name": "redis", "volumeMounts": [{"name": "redis-data", "mountPath": "/bitnami/redis/data"}]}]
+			}}}
+		}`))
+		assert.True(t, resp.Allowed)
+		assert.Nil(t, resp.Patch, "the deployment template is mutated instead")
+	})
+
+	t.Run("pod owned by a replicaset", func(t *testing.T) {
+		resp := svr.mutate(review(metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, `{
+			"metadata": {"name": "redis-5d4f8-x2x", "ownerReferences": [{"apiVersion": "apps/v1", "kind": "ReplicaSet", "name": "redis-5d4f8", "uid": "2", "controller": true}]},
+			"spec": {
+				"securityContext": {"fsGroup": 1001},
+				"containers": [{"name": "redis", "volumeMounts": [{"name": "redis-data", "mountPath": "/bitnami/redis/data"}]}]
+			}
+		}`))
+		assert.True(t, resp.Allowed)
+		assert.NotNil(t, resp.Patch, "pods are mutated whatever owns them")
+	})
+
+	t.Run("skipped pod keeps its warnings", func(t *testing.T) {
+		cfg := &MutationConfig{ImageInspection: &ImageInspection{Enabled: true}}
+		svr := &WebhookServer{config: cfg, images: newImageInspectorFor(cfg)}
+		resp := svr.mutate(review(metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, `{
+			"metadata": {"name": "app"},
+			"spec": {
+				"containers": [{"name": "app", "image": "127.0.0.1:5000/team/app:v1", "volumeMounts": [{"name": "data", "mountPath": "/data"}]}],
+				"volumes": [{"name": "data", "persistentVolumeClaim": {"claimName": "data"}}]
+			}
+		}`))
+		assert.True(t, resp.Allowed)
+		assert.Nil(t, resp.Patch)
+		assert.Equal(t, []string{"could not look up the user of image 127.0.0.1:5000/team/app:v1, the webhook logs tell why"}, resp.Warnings)
+	})
+}
+
+func TestEvaluateStorageClasses(t *testing.T) {
+	nfs, local := "nfs-client", "local-path"
+	statefulSet := func(class *string) *podTemplate {
+		sts := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "sentry-redis-master", Namespace: "sentry-pro"},
+			Spec: appsv1.StatefulSetSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								VolumeMounts: []corev1.VolumeMount{
+									{Name: "config", MountPath: "/opt/bitnami/redis/etc"},
+									{Name: "redis-data", MountPath: "/bitnami/redis/data"},
+								},
+							},
+						},
+						SecurityContext: &corev1.PodSecurityContext{
+							FSGroup: func(i int64) *int64 { return &i }(1001),
+						},
+						Volumes: []corev1.Volume{
+							{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}},
+						},
+					},
+				},
+				VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+					{
+						ObjectMeta: metav1.ObjectMeta{Name: "redis-data"},
+						Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: class},
+					},
+				},
+			},
+		}
+		tmpl, err := podTemplateFor(sts)
+		assert.NoError(t, err)
+		return tmpl
+	}
+	pod := func() *podTemplate {
+		pod := posCases[3].pod.DeepCopy()
+		pod.Namespace = "sentry-pro"
+		tmpl, err := podTemplateFor(pod)
+		assert.NoError(t, err)
+		return tmpl
+	}
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "redis", Namespace: "sentry-pro"},
+		Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &local},
+	}
+
+	tests := []struct {
+		name      string
+		tmpl      *podTemplate
+		classes   []string
+		clientset kubernetes.Interface
+		inject    bool
+	}{
+		{name: "claim template mount is chowned", tmpl: statefulSet(nil), inject: true},
+		{name: "claim template of allowed class", tmpl: statefulSet(&nfs), classes: []string{nfs}, inject: true},
+		{name: "claim template of other class", tmpl: statefulSet(&local), classes: []string{nfs}},
+		{name: "claim template of unknown class", tmpl: statefulSet(nil), classes: []string{nfs}, inject: true},
+		{name: "pod claim of other class", tmpl: pod(), classes: []string{nfs}, clientset: fake.NewSimpleClientset(claim)},
+		{name: "pod claim of allowed class", tmpl: pod(), classes: []string{local}, clientset: fake.NewSimpleClientset(claim), inject: true},
+		{name: "pod claim without clientset", tmpl: pod(), classes: []string{nfs}, inject: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &mutator{config: &MutationConfig{StorageClassNames: tt.classes}, clientset: tt.clientset}
+			d, err := m.evaluate(context.TODO(), tt.tmpl)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.inject, d.inject, d.reason)
+			if tt.inject {
+				assert.Equal(t, "1001:1001 /bitnami/redis/data", d.targets[0].String())
+			}
+		})
+	}
+}
+
+func TestEvaluateSubPath(t *testing.T) {
+	pod := func(mount corev1.VolumeMount) *podTemplate {
+		return &podTemplate{
+			meta: &metav1.ObjectMeta{Name: "postgres-0", Namespace: "sentry-pro"},
+			spec: &corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name: "postgres",
+						Env: []corev1.EnvVar{
+							{Name: "PGDATA", Value: "/var/lib/postgresql/data/pgdata"},
+							{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+						},
+						VolumeMounts: []corev1.VolumeMount{mount},
+					},
+				},
+				SecurityContext: &corev1.PodSecurityContext{
+					FSGroup: func(i int64) *int64 { return &i }(999),
+				},
+				Volumes: []corev1.Volume{
+					{Name: "shared", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "shared"}}},
+				},
+			},
+		}
+	}
+	m := &mutator{}
+
+	t.Run("subPath", func(t *testing.T) {
+		d, err := m.evaluate(context.TODO(), pod(corev1.VolumeMount{Name: "shared", MountPath: "/var/lib/postgresql/data", SubPath: "postgres"}))
+		assert.NoError(t, err)
+		assert.Equal(t, "999:999 /var/lib/postgresql/data subPath=postgres", d.targets[0].String())
+		assert.Equal(t, []corev1.VolumeMount{{Name: "shared", MountPath: "/var/lib/postgresql/data", SubPath: "postgres"}}, d.initContainers[0].VolumeMounts)
+		assert.Empty(t, d.initContainers[0].Env)
+	})
+
+	t.Run("subPathExpr", func(t *testing.T) {
+		d, err := m.evaluate(context.TODO(), pod(corev1.VolumeMount{Name: "shared", MountPath: "/var/lib/postgresql/data", SubPathExpr: "$(POD_NAME)"}))
+		assert.NoError(t, err)
+		assert.Equal(t, []corev1.VolumeMount{{Name: "shared", MountPath: "/var/lib/postgresql/data", SubPathExpr: "$(POD_NAME)"}}, d.initContainers[0].VolumeMounts)
+		if assert.Len(t, d.initContainers[0].Env, 1) {
+			assert.Equal(t, "POD_NAME", d.initContainers[0].Env[0].Name)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// podTemplate locates the pod metadata and spec carried by an object together
+// with the JSON pointer under which they live in that object
+type podTemplate struct {
+	meta     *metav1.ObjectMeta
+	spec     *corev1.PodSpec
+	basePath string
+	// claimTemplates are the volumeClaimTemplates of a StatefulSet
+	claimTemplates []corev1.PersistentVolumeClaim
+	// controller is the controller owning the workload, like the Deployment
+	// of a ReplicaSet or the CronJob of a Job. The template is mutated
+	// through the controller, it is nil for pods.
+	controller *metav1.OwnerReference
+	// job is set for the templates of Jobs and CronJobs, whose pods run to
+	// completion
+	job bool
+	// podNames are the names of the pods of the template when they are known
+	// at admission: the pod itself or the replicas of a StatefulSet
+	podNames []string
+	// bareMeta is set when the workload template carries no metadata, the
+	// patch adds it whole as there is no object to add the annotations to
+	bareMeta bool
+}
+
+func init() {
+	_ = appsv1.AddToScheme(runtimeScheme)
+	_ = batchv1.AddToScheme(runtimeScheme)
+	_ = batchv1beta1.AddToScheme(runtimeScheme)
+}
+
+// decodeObject decodes the raw object of an admission request into the typed
+// object registered for its kind
+func decodeObject(kind metav1.GroupVersionKind, raw []byte) (runtime.Object, error) {
+	obj, err := runtimeScheme.New(schema.GroupVersionKind(kind))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported kind %s", schema.GroupVersionKind(kind))
+	}
+	if err := json.Unmarshal(raw, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// podTemplateFor returns the pod template of the supported kinds: pods and the
+// workloads that create them
+func podTemplateFor(obj runtime.Object) (*podTemplate, error) {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		tmpl := &podTemplate{meta: &o.ObjectMeta, spec: &o.Spec}
+		if o.Name != "" {
+			tmpl.podNames = []string{o.Name}
+		}
+		return tmpl, nil
+	case *appsv1.Deployment:
+		return newWorkloadTemplate(&o.ObjectMeta, &o.Spec.Template, "/spec/template"), nil
+	case *appsv1.StatefulSet:
+		tmpl := newWorkloadTemplate(&o.ObjectMeta, &o.Spec.Template, "/spec/template")
+		tmpl.claimTemplates = o.Spec.VolumeClaimTemplates
+		replicas := int32(1)
+		if o.Spec.Replicas != nil {
+			replicas = *o.Spec.Replicas
+		}
+		for i := int32(0); i < replicas; i++ {
+			tmpl.podNames = append(tmpl.podNames, fmt.Sprintf("%s-%d", o.Name, i))
+		}
+		return tmpl, nil
+	case *appsv1.DaemonSet:
+		return newWorkloadTemplate(&o.ObjectMeta, &o.Spec.Template, "/spec/template"), nil
+	case *appsv1.ReplicaSet:
+		return newWorkloadTemplate(&o.ObjectMeta, &o.Spec.Template, "/spec/template"), nil
+	case *batchv1.Job:
+		tmpl := newWorkloadTemplate(&o.ObjectMeta, &o.Spec.Template, "/spec/template")
+		tmpl.job = true
+		return tmpl, nil
+	case *batchv1beta1.CronJob:
+		tmpl := newWorkloadTemplate(&o.ObjectMeta, &o.Spec.JobTemplate.Spec.Template, "/spec/jobTemplate/spec/template")
+		tmpl.job = true
+		return tmpl, nil
+	}
+	return nil, fmt.Errorf("unsupported kind %s", reflect.TypeOf(obj).Elem().Name())
+}
+
+// newWorkloadTemplate wraps the pod template of a workload. The template
+// metadata inherits the workload name and namespace when it has none so the
+// namespace policy and logging behave as they do for pods. The controller of
+// the workload is recorded so owned workloads are left to it.
+func newWorkloadTemplate(owner *metav1.ObjectMeta, template *corev1.PodTemplateSpec, basePath string) *podTemplate {
+	meta := template.ObjectMeta.DeepCopy()
+	if meta.Name == "" {
+		meta.Name = owner.Name
+	}
+	if meta.Namespace == "" {
+		meta.Namespace = owner.Namespace
+	}
+	return &podTemplate{
+		meta:       meta,
+		spec:       &template.Spec,
+		basePath:   basePath,
+		controller: metav1.GetControllerOf(owner),
+		bareMeta:   reflect.DeepEqual(template.ObjectMeta, metav1.ObjectMeta{}),
+	}
+}
+
+// volumes returns the pod volumes together with the volumes the StatefulSet
+// controller creates from the claim templates. Like the controller, a claim
+// template replaces a pod volume of the same name.
+func (t *podTemplate) volumes() []corev1.Volume {
+	if len(t.claimTemplates) == 0 {
+		return t.spec.Volumes
+	}
+
+	var volumes []corev1.Volume
+	for _, v := range t.spec.Volumes {
+		if t.claimTemplate(v.Name) == nil {
+			volumes = append(volumes, v)
+		}
+	}
+	for _, claim := range t.claimTemplates {
+		volumes = append(volumes, corev1.Volume{
+			Name: claim.Name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim.Name},
+			},
+		})
+	}
+	return volumes
+}
+
+// claimTemplate returns the claim template of the given name
+func (t *podTemplate) claimTemplate(name string) *corev1.PersistentVolumeClaim {
+	for i, claim := range t.claimTemplates {
+		if claim.Name == name {
+			return &t.claimTemplates[i]
+		}
+	}
+	return nil
+}